@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Compare two secrets in constant time. They are hashed first, so that
+// not even their length leaks.
+func secretsEqual(a string, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// Check if a request carries the credentials configured in the http
+// section, either as basic auth or as a bearer token.
+func authorized(r *http.Request) bool {
+	cfg := getConfig()
+	if token := cfg.getString("http", "token", ""); token != "" {
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") && secretsEqual(strings.TrimPrefix(auth, "Bearer "), token) {
+			return true
+		}
+	}
+	if username := cfg.getString("http", "username", ""); username != "" {
+		u, p, ok := r.BasicAuth()
+		// Always compare both, so the time taken doesn't tell
+		// which one was wrong.
+		userok := secretsEqual(u, username)
+		passok := secretsEqual(p, cfg.getString("http", "password", ""))
+		if ok && userok && passok {
+			return true
+		}
+	}
+	return false
+}
+
+// Endpoints used by load balancers and orchestrators for health probes,
+// which can't be expected to authenticate. They don't reveal anything
+// beyond whether the cluster is healthy.
+var probeEndpoints = map[string]bool{
+	"/health": true,
+	"/livez":  true,
+	"/readyz": true,
+}
+
+// Require authentication for requests to the http interface, if any
+// credentials are configured. Requests that change something, which is
+// anything but GET and HEAD, always require it, while the read-only
+// ones can be left open using authstatus. The health probes are always
+// left open. If tlsclientca is set, the requests that change something
+// also need a verified client certificate.
+func requireAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := getConfig()
+		readonly := r.Method == "GET" || r.Method == "HEAD"
+		if readonly && probeEndpoints[r.URL.Path] {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if !readonly && cfg.getString("http", "tlsclientca", "") != "" && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			http.Error(w, "Client certificate required", http.StatusForbidden)
+			return
+		}
+		if cfg.getString("http", "username", "") == "" && cfg.getString("http", "token", "") == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if readonly && !cfg.getBool("http", "authstatus", true) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if !authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="rebouncer"`)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Build the TLS configuration for the http listener from the http
+// section, or return nil if TLS is not configured. The certificates
+// are loaded right away, so any problem with them is found at startup.
+func getHttpTlsConfig() (*tls.Config, error) {
+	cfg := getConfig()
+	certfile := cfg.getString("http", "tlscert", "")
+	keyfile := cfg.getString("http", "tlskey", "")
+	if certfile == "" && keyfile == "" {
+		return nil, nil
+	}
+	if certfile == "" || keyfile == "" {
+		return nil, errors.New("tlscert and tlskey must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		return nil, err
+	}
+	tlsconfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	// Client certificates are only required for requests that change
+	// something, so just verify the ones that are sent here, and
+	// leave the rest to requireAuth.
+	if cafile := cfg.getString("http", "tlsclientca", ""); cafile != "" {
+		pem, err := os.ReadFile(cafile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + cafile)
+		}
+		tlsconfig.ClientCAs = pool
+		tlsconfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsconfig, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAuth(t *testing.T) {
+	handler := requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	credentials := section{"username": "admin", "password": "secret", "token": "tok"}
+
+	tests := []struct {
+		name     string
+		http     section
+		method   string
+		path     string
+		username string
+		password string
+		bearer   string
+		expected int
+	}{
+		{"no credentials configured", section{}, "GET", "/", "", "", "", 200},
+		{"no credentials configured, mutating", section{}, "POST", "/failover", "", "", "", 200},
+		{"basic auth", credentials, "GET", "/", "admin", "secret", "", 200},
+		{"basic auth, mutating", credentials, "POST", "/failover", "admin", "secret", "", 200},
+		{"basic auth, wrong password", credentials, "GET", "/", "admin", "wrong", "", 401},
+		{"basic auth, wrong username", credentials, "GET", "/", "other", "secret", "", 401},
+		{"bearer token", credentials, "GET", "/", "", "", "tok", 200},
+		{"bearer token, mutating", credentials, "POST", "/pin", "", "", "tok", 200},
+		{"bearer token, wrong token", credentials, "GET", "/", "", "", "wrong", 401},
+		{"bearer token only", section{"token": "tok"}, "GET", "/", "", "", "tok", 200},
+		{"bearer token only, basic auth", section{"token": "tok"}, "GET", "/", "admin", "", "", 401},
+		{"no authentication", credentials, "GET", "/", "", "", "", 401},
+		{"no authentication, mutating", credentials, "POST", "/disable", "", "", "", 401},
+		{"authstatus off", section{"username": "admin", "password": "secret", "authstatus": "off"}, "GET", "/nodes", "", "", "", 200},
+		{"authstatus off, mutating", section{"username": "admin", "password": "secret", "authstatus": "off"}, "POST", "/failover", "", "", "", 401},
+		{"health", credentials, "GET", "/health", "", "", "", 200},
+		{"livez", credentials, "GET", "/livez", "", "", "", 200},
+		{"readyz", credentials, "HEAD", "/readyz", "", "", "", 200},
+		{"health, mutating", credentials, "POST", "/health", "", "", "", 401},
+		{"client certificate required", section{"tlsclientca": "ca.pem"}, "POST", "/failover", "", "", "", 403},
+		{"client certificate not required for reading", section{"tlsclientca": "ca.pem"}, "GET", "/", "", "", "", 200},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setConfig(Config{"http": test.http})
+			r := httptest.NewRequest(test.method, test.path, nil)
+			if test.username != "" || test.password != "" {
+				r.SetBasicAuth(test.username, test.password)
+			}
+			if test.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+test.bearer)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != test.expected {
+				t.Errorf("expected status %d, got %d", test.expected, w.Code)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("no WWW-Authenticate header on 401")
+			}
+		})
+	}
+}
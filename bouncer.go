@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"go.opentelemetry.io/otel/codes"
+	"sort"
+	"time"
+)
+
+// A pgbouncer instance that is reconfigured on failover
+type Bouncer struct {
+	name    string
+	connstr string
+	symlink string
+}
+
+func (b Bouncer) String() string {
+	if b.name == "" {
+		return "pgbouncer"
+	}
+	return "pgbouncer " + b.name
+}
+
+// Return all pgbouncers to reconfigure on failover. If there is no
+// bouncers section, it's the single one from the global section.
+func getBouncers() []Bouncer {
+	cfg := getConfig()
+	if len(cfg["bouncers"]) == 0 {
+		return []Bouncer{{connstr: cfg["global"]["pgbouncer"], symlink: cfg["global"]["symlink"]}}
+	}
+
+	names := []string{}
+	for name := range cfg["bouncers"] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bouncers := []Bouncer{}
+	for _, name := range names {
+		bouncers = append(bouncers, Bouncer{
+			name:    name,
+			connstr: cfg["bouncers"][name],
+			symlink: cfg.getString("symlinks", name, cfg["global"]["symlink"]),
+		})
+	}
+	return bouncers
+}
+
+// The database/sql driver used to talk to pgbouncer. Only replaced in
+// tests, with a fake pgbouncer.
+var bouncerDriver = "postgres"
+
+// Return a validated connection to pgbouncer. If no connection
+// can be made, logs the error and returns nil.
+func getValidBouncerConnection(b Bouncer) *sql.DB {
+	bouncer, err := sql.Open(bouncerDriver, b.connstr)
+	if err != nil {
+		logError("could not connect to %s: %s", b, maskPassword(err.Error()))
+		return nil
+	}
+	bouncer.SetMaxIdleConns(0)
+
+	err = bouncer.Ping()
+	if err != nil {
+		logError("could not connect to %s: %s", b, maskPassword(err.Error()))
+		return nil
+	}
+
+	return bouncer
+}
+
+// Return validated connections to all the given pgbouncers, in the
+// same order. If any of them can't be connected to, logs the error
+// and returns nil.
+func getValidBouncerConnections(bouncers []Bouncer) []*sql.DB {
+	conns := []*sql.DB{}
+	for _, b := range bouncers {
+		conn := getValidBouncerConnection(b)
+		if conn == nil {
+			closeBouncerConnections(conns)
+			return nil
+		}
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func closeBouncerConnections(conns []*sql.DB) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// Pause all the given pgbouncers, waiting for active queries to finish,
+// so that no query is sent to the old master while we switch. If they
+// don't all finish within the drain timeout, we give up waiting and
+// continue anyway, since the failover is more important.
+func pauseBouncers(ctx context.Context, failoverid string, bouncers []Bouncer, conns []*sql.DB) {
+	_, span := tracer.Start(ctx, "pause")
+	defer span.End()
+
+	timeout := time.After(getConfig().getDuration("global", "draintimeout", 10*time.Second))
+
+	type pauseResult struct {
+		bouncer Bouncer
+		err     error
+	}
+	retchan := make(chan pauseResult, len(conns))
+	for i, conn := range conns {
+		go func(b Bouncer, conn *sql.DB) {
+			_, err := conn.Exec("PAUSE")
+			retchan <- pauseResult{b, err}
+		}(bouncers[i], conn)
+	}
+
+	for _ = range conns {
+		select {
+		case r := <-retchan:
+			if r.err != nil {
+				logWarn("failover %s: failed to pause %s, continuing anyway: %s", failoverid, r.bouncer, maskPassword(r.err.Error()))
+				span.RecordError(r.err)
+				span.SetStatus(codes.Error, "failed to pause pgbouncer")
+			}
+		case <-timeout:
+			logWarn("failover %s: timed out waiting for queries to drain, continuing anyway", failoverid)
+			span.SetStatus(codes.Error, "timed out waiting for queries to drain")
+			return
+		}
+	}
+	logInfo("failover %s: pgbouncer paused", failoverid)
+}
+
+// Resume all the given pgbouncers after a pause. This is attempted on
+// all of them whether the failover worked or not, so we never leave
+// pgbouncer paused.
+func resumeBouncers(ctx context.Context, failoverid string, bouncers []Bouncer, conns []*sql.DB) {
+	_, span := tracer.Start(ctx, "resume")
+	defer span.End()
+
+	for i, conn := range conns {
+		_, err := conn.Exec("RESUME")
+		if err != nil {
+			logError("failover %s: failed to resume %s: %s", failoverid, bouncers[i], maskPassword(err.Error()))
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to resume pgbouncer")
+		}
+	}
+}
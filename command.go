@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A command for the main loop, sent from the http interface. All
+// changes to the state are made by the main loop itself, so the http
+// handlers never touch it directly.
+type Command struct {
+	action  string
+	server  string
+	force   bool
+	connstr string
+	reply   chan CommandResult
+}
+
+// The result of a command, with the http status code to return
+type CommandResult struct {
+	code    int
+	message string
+}
+
+// Global channel to send commands to the main loop
+var commandchan chan Command
+
+// Send a command to the main loop and wait for the result. The main
+// loop only picks up commands between polls, so give up if it hasn't
+// done so within one interval (it may still be waiting for pgbouncer).
+func sendCommand(r *http.Request, cmd Command) CommandResult {
+	cmd.reply = make(chan CommandResult, 1)
+
+	select {
+	case commandchan <- cmd:
+	case <-time.After(getConfig().getDuration("global", "interval", 30*time.Second)):
+		return CommandResult{http.StatusServiceUnavailable, "Main loop is busy, try again later"}
+	case <-r.Context().Done():
+		return CommandResult{http.StatusServiceUnavailable, "Request cancelled"}
+	}
+	return <-cmd.reply
+}
+
+// Parse the server name and force flag out of a request, either from
+// a JSON body or from regular form fields.
+func parseCommandRequest(r *http.Request) (string, bool, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req struct {
+			Server string `json:"server"`
+			Force  bool   `json:"force"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			return "", false, fmt.Errorf("Invalid JSON: %s", err)
+		}
+		return req.Server, req.Force, nil
+	}
+
+	force := false
+	if r.FormValue("force") != "" {
+		var err error
+		force, err = strconv.ParseBool(r.FormValue("force"))
+		if err != nil {
+			return "", false, fmt.Errorf("Invalid value for force: %s", r.FormValue("force"))
+		}
+	}
+	return r.FormValue("server"), force, nil
+}
+
+// Reconfigure pgbouncer for a specific server right away, without
+// waiting for it to be detected as the new master.
+func httpFailoverHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	server, force, err := parseCommandRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if server == "" {
+		http.Error(w, "No server specified", http.StatusBadRequest)
+		return
+	}
+
+	result := sendCommand(r, Command{action: "failover", server: server, force: force})
+	if result.code != http.StatusOK {
+		http.Error(w, result.message, result.code)
+		return
+	}
+	fmt.Fprintf(w, "%s\n", result.message)
+}
+
+// Pin the master to a specific server (POST), or stop doing so (DELETE).
+func httpPinHandler(w http.ResponseWriter, r *http.Request) {
+	var result CommandResult
+	switch r.Method {
+	case "POST":
+		server, force, err := parseCommandRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if server == "" {
+			http.Error(w, "No server specified", http.StatusBadRequest)
+			return
+		}
+		result = sendCommand(r, Command{action: "pin", server: server, force: force})
+	case "DELETE":
+		result = sendCommand(r, Command{action: "unpin"})
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "Only POST and DELETE are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if result.code != http.StatusOK {
+		http.Error(w, result.message, result.code)
+		return
+	}
+	fmt.Fprintf(w, "%s\n", result.message)
+}
+
+// Run a command that takes no arguments, for the simple endpoints
+func runSimpleCommand(w http.ResponseWriter, r *http.Request, action string) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result := sendCommand(r, Command{action: action})
+	if result.code != http.StatusOK {
+		http.Error(w, result.message, result.code)
+		return
+	}
+	fmt.Fprintf(w, "%s\n", result.message)
+}
+
+// Start reconfiguring pgbouncer again after being disabled
+func httpEnableHandler(w http.ResponseWriter, r *http.Request) {
+	runSimpleCommand(w, r, "enable")
+}
+
+// Keep polling and reporting status, but never reconfigure pgbouncer
+func httpDisableHandler(w http.ResponseWriter, r *http.Request) {
+	runSimpleCommand(w, r, "disable")
+}
+
+// Add a server (POST to /servers), or remove one (DELETE to
+// /servers/<name>), without reloading the configuration.
+func httpServersHandler(w http.ResponseWriter, r *http.Request) {
+	var result CommandResult
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/servers"), "/")
+	switch {
+	case r.Method == "POST" && name == "":
+		var req struct {
+			Name    string `json:"name"`
+			Connstr string `json:"connstr"`
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid JSON: %s", err), http.StatusBadRequest)
+				return
+			}
+		} else {
+			req.Name = r.FormValue("name")
+			req.Connstr = r.FormValue("connstr")
+		}
+		if req.Name == "" || strings.Contains(req.Name, "/") {
+			http.Error(w, "No valid server name specified", http.StatusBadRequest)
+			return
+		}
+		result = sendCommand(r, Command{action: "addserver", server: req.Name, connstr: req.Connstr})
+	case r.Method == "DELETE" && name != "":
+		result = sendCommand(r, Command{action: "removeserver", server: name})
+	case name == "":
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	default:
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "Only DELETE is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if result.code != http.StatusOK {
+		http.Error(w, result.message, result.code)
+		return
+	}
+	fmt.Fprintf(w, "%s\n", result.message)
+}
+
+// Put a server in maintenance (POST), or take it out of maintenance
+// again (DELETE).
+func httpMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	var action string
+	switch r.Method {
+	case "POST":
+		action = "maintenance"
+	case "DELETE":
+		action = "endmaintenance"
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "Only POST and DELETE are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	server, force, err := parseCommandRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if server == "" {
+		http.Error(w, "No server specified", http.StatusBadRequest)
+		return
+	}
+
+	result := sendCommand(r, Command{action: action, server: server, force: force})
+	if result.code != http.StatusOK {
+		http.Error(w, result.message, result.code)
+		return
+	}
+	fmt.Fprintf(w, "%s\n", result.message)
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"bufio"
-	"log"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type section map[string]string
@@ -25,20 +30,148 @@ func (c Config) getInt(section string, key string, defaultval int64) int64 {
 	}
 }
 
-func loadConfig(filename string) Config {
+func (c Config) getString(section string, key string, defaultval string) string {
+	val, ok := c[section][key]
+	if ok {
+		return val
+	} else {
+		return defaultval
+	}
+}
+
+// Boolean values can be given as true/false, yes/no, on/off or 1/0.
+func (c Config) getBool(section string, key string, defaultval bool) bool {
+	val, ok := c[section][key]
+	if ok {
+		switch strings.ToLower(strings.TrimSpace(val)) {
+		case "1", "true", "yes", "on":
+			return true
+		case "0", "false", "no", "off":
+			return false
+		}
+		return defaultval
+	} else {
+		return defaultval
+	}
+}
+
+// Durations can be given either as a go duration string like "500ms"
+// or "30s", or as a plain integer which is interpreted as seconds.
+func (c Config) getDuration(section string, key string, defaultval time.Duration) time.Duration {
+	val, ok := c[section][key]
+	if ok {
+		i, err := strconv.ParseInt(val, 10, 32)
+		if err == nil {
+			return time.Duration(i) * time.Second
+		}
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return defaultval
+		} else {
+			return d
+		}
+	} else {
+		return defaultval
+	}
+}
+
+// Make a deep copy of a configuration that can be modified safely
+func (c Config) clone() Config {
+	n := make(Config, len(c))
+	for name, sect := range c {
+		n[name] = make(section, len(sect))
+		for k, v := range sect {
+			n[name][k] = v
+		}
+	}
+	return n
+}
+
+// The active configuration. It is replaced when the configuration is
+// reloaded, so it must only be accessed through getConfig().
+var activeConfig Config
+var configLock sync.RWMutex
+
+func getConfig() Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return activeConfig
+}
+
+func setConfig(c Config) {
+	configLock.Lock()
+	defer configLock.Unlock()
+	activeConfig = c
+
+	// lib/pq reads the password file itself whenever a connection
+	// string has no password, so just point it to the right one.
+	if c["global"]["passfile"] != "" {
+		os.Setenv("PGPASSFILE", c["global"]["passfile"])
+	}
+}
+
+// Expand references to environment variables, in the form $VAR or
+// ${VAR}, in a configuration value. A literal $ is written as $$.
+// Referencing a variable that is not set is an error, rather than
+// silently expanding to an empty string.
+func expandEnv(val string) (string, error) {
+	missing := []string{}
+	expanded := os.Expand(val, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("Environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// Read and parse a configuration file
+func readConfig(filename string) (Config, error) {
+	cfg := make(Config)
+	err := parseConfigFile(filename, cfg, []string{})
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Parse one configuration file, merging its contents into cfg. Files
+// pulled in with an include directive are parsed recursively, and
+// values in later files override earlier ones. includestack holds the
+// files currently being parsed, to detect include cycles.
+func parseConfigFile(filename string, cfg Config, includestack []string) error {
+	abspath, err := filepath.Abs(filename)
+	if err != nil {
+		return fmt.Errorf("Could not open configuration file: %v", err)
+	}
+	for _, f := range includestack {
+		if f == abspath {
+			return fmt.Errorf("Include cycle detected: %s includes itself", filename)
+		}
+	}
+	includestack = append(includestack, abspath)
+
 	file, err := os.Open(filename)
 	if err != nil {
-		log.Fatalf("Could not open configuration file: %v", err)
+		return fmt.Errorf("Could not open configuration file: %v", err)
 	}
 	defer file.Close()
 
 	scanner := bufio.NewScanner(file)
 
-	cfg := make(Config)
-	var currsection section
-	var currsectionname string
-	currsection = nil
-	currsectionname = ""
+	currsectionname := ""
+
+	// Sections and keys seen in this file, to catch duplicates. Only
+	// an included file is allowed to override a value.
+	seensections := make(map[string]bool)
+	seenkeys := make(map[string]bool)
 
 	linenum := 0
 	for scanner.Scan() {
@@ -50,25 +183,379 @@ func loadConfig(filename string) Config {
 		}
 		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
 			// This is a new section
-			if currsectionname != "" {
-				cfg[currsectionname] = currsection
-			}
-			currsection = make(section)
 			currsectionname = strings.TrimRight(strings.TrimLeft(text, "["), "]")
+			if seensections[currsectionname] {
+				return fmt.Errorf("%s: Duplicate section [%s] on line %d", filename, currsectionname, linenum)
+			}
+			seensections[currsectionname] = true
+			if cfg[currsectionname] == nil {
+				cfg[currsectionname] = make(section)
+			}
 		} else if !strings.Contains(text, "=") {
-			log.Fatalf("Missing = sign on line %d (%s)", linenum, text)
+			return fmt.Errorf("%s: Missing = sign on line %d (%s)", filename, linenum, text)
 		} else {
+			s := strings.SplitN(text, "=", 2)
+			val, err := expandEnv(s[1])
+			if err != nil {
+				return fmt.Errorf("%s: %s on line %d", filename, err, linenum)
+			}
+
+			if strings.TrimSpace(s[0]) == "include" {
+				// Include another file, relative to the directory of
+				// this one.
+				path := strings.TrimSpace(val)
+				if !filepath.IsAbs(path) {
+					path = filepath.Join(filepath.Dir(filename), path)
+				}
+				err = parseConfigFile(path, cfg, includestack)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
 			if currsectionname == "" {
-				log.Fatal("Config value without section!")
+				return fmt.Errorf("%s: Config value without section on line %d", filename, linenum)
+			}
+			if seenkeys[currsectionname+"."+s[0]] {
+				return fmt.Errorf("%s: Duplicate key %s in section [%s] on line %d", filename, s[0], currsectionname, linenum)
 			}
+			seenkeys[currsectionname+"."+s[0]] = true
+			cfg[currsectionname][s[0]] = val
+		}
+	}
 
-			s := strings.SplitN(text, "=", 2)
-			currsection[s[0]] = s[1]
+	return nil
+}
+
+// Check that a pgbouncer configuration file for a server looks usable,
+// so a broken one is never symlinked and loaded into pgbouncer. It must
+// parse as an ini file and have a [databases] section, unless it pulls
+// in other files with %include, which are not followed.
+func checkBouncerConfig(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	empty := true
+	hasdatabases := false
+	hasinclude := false
+	currsectionname := ""
+	linenum := 0
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		linenum++
+
+		if text == "" || strings.HasPrefix(text, ";") || strings.HasPrefix(text, "#") {
+			continue
+		}
+		empty = false
+		if strings.HasPrefix(text, "%include") {
+			hasinclude = true
+		} else if strings.HasPrefix(text, "[") {
+			if !strings.HasSuffix(text, "]") {
+				return fmt.Errorf("%s: Malformed section header on line %d (%s)", filename, linenum, text)
+			}
+			currsectionname = strings.TrimSpace(text[1 : len(text)-1])
+			if currsectionname == "databases" {
+				hasdatabases = true
+			}
+		} else if !strings.Contains(text, "=") {
+			return fmt.Errorf("%s: Missing = sign on line %d", filename, linenum)
+		} else if currsectionname == "" {
+			return fmt.Errorf("%s: Value without section on line %d", filename, linenum)
 		}
 	}
-	if currsectionname != "" {
-		cfg[currsectionname] = currsection
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+
+	if empty {
+		return fmt.Errorf("%s: File is empty", filename)
+	}
+	if !hasdatabases && !hasinclude {
+		return fmt.Errorf("%s: No [databases] section", filename)
 	}
+	return nil
+}
 
+// Read and parse a configuration file, exiting on any error
+func loadConfig(filename string) Config {
+	cfg, err := readConfig(filename)
+	if err != nil {
+		logFatal("%s", err)
+	}
 	return cfg
 }
+
+// Validate that the configuration has everything required to run.
+// All problems found are reported, not just the first one.
+func validateConfig(c Config) error {
+	problems := []string{}
+
+	// In template mode, the configuration for pgbouncer is generated
+	// instead of switching a symlink between files in configdir.
+	templatemode := c["global"]["template"] != ""
+	keys := []string{"configdir"}
+	if templatemode {
+		keys = []string{"output"}
+	}
+	if len(c["bouncers"]) == 0 {
+		keys = append(keys, "pgbouncer")
+		if !templatemode {
+			keys = append(keys, "symlink")
+		}
+	}
+	for _, key := range keys {
+		if c["global"][key] == "" {
+			problems = append(problems, "global."+key+" is not set")
+		}
+	}
+
+	if c["global"]["configdir"] != "" {
+		fi, err := os.Stat(c["global"]["configdir"])
+		if err != nil {
+			problems = append(problems, "configdir: "+err.Error())
+		} else if !fi.IsDir() {
+			problems = append(problems, "configdir "+c["global"]["configdir"]+" is not a directory")
+		}
+	}
+
+	if templatemode {
+		if _, err := parseBouncerTemplate(c["global"]["template"]); err != nil {
+			problems = append(problems, "template: "+err.Error())
+		}
+	}
+
+	// Figure out all the symlinks we will have to replace, or the
+	// output file in template mode
+	symlinks := []string{}
+	if templatemode {
+		if c["global"]["output"] != "" {
+			symlinks = append(symlinks, c["global"]["output"])
+		}
+	} else if len(c["bouncers"]) == 0 {
+		if c["global"]["symlink"] != "" {
+			symlinks = append(symlinks, c["global"]["symlink"])
+		}
+	}
+	if len(c["bouncers"]) > 0 {
+		bouncernames := []string{}
+		for name := range c["bouncers"] {
+			bouncernames = append(bouncernames, name)
+		}
+		sort.Strings(bouncernames)
+		for _, name := range bouncernames {
+			if strings.TrimSpace(c["bouncers"][name]) == "" {
+				problems = append(problems, "bouncer "+name+" has an empty connection string")
+			}
+			if templatemode {
+				continue
+			}
+			symlink := c.getString("symlinks", name, c["global"]["symlink"])
+			if symlink == "" {
+				problems = append(problems, "bouncer "+name+" has no symlink and global.symlink is not set")
+			} else {
+				symlinks = append(symlinks, symlink)
+			}
+		}
+		symlinknames := []string{}
+		for name := range c["symlinks"] {
+			symlinknames = append(symlinknames, name)
+		}
+		sort.Strings(symlinknames)
+		for _, name := range symlinknames {
+			if _, ok := c["bouncers"][name]; !ok {
+				problems = append(problems, "symlink configured for unknown bouncer "+name)
+			}
+		}
+	}
+
+	// The read symlink is reloaded through its own pgbouncer, which
+	// defaults to the global one, but that's not set when there is a
+	// bouncers section.
+	if c["global"]["readsymlink"] != "" {
+		symlinks = append(symlinks, c["global"]["readsymlink"])
+		if c["global"]["readpgbouncer"] == "" && c["global"]["pgbouncer"] == "" {
+			problems = append(problems, "global.readsymlink is set, but neither global.readpgbouncer nor global.pgbouncer is")
+		}
+	}
+
+	checked := make(map[string]bool)
+	for _, symlink := range symlinks {
+		// The only reliable way to know if we can replace the
+		// symlink is to try to create a file next to it.
+		dir := filepath.Dir(symlink)
+		if checked[dir] {
+			continue
+		}
+		checked[dir] = true
+		f, err := os.CreateTemp(dir, ".rebouncer")
+		if err != nil {
+			problems = append(problems, "directory of "+symlink+" is not writable: "+err.Error())
+		} else {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
+
+	if len(c["servers"]) == 0 {
+		problems = append(problems, "no servers configured")
+	}
+	names := []string{}
+	for name := range c["servers"] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.TrimSpace(c["servers"][name]) == "" {
+			problems = append(problems, "server "+name+" has an empty connection string")
+		} else if _, err := normalizeConnStr(c["servers"][name]); err != nil {
+			problems = append(problems, "server "+name+": "+err.Error())
+		}
+		if c["global"]["configdir"] != "" && !templatemode {
+			err := checkBouncerConfig(fmt.Sprintf("%s/%s.ini", strings.TrimRight(c["global"]["configdir"], "/"), name))
+			if err != nil {
+				problems = append(problems, "server "+name+": "+err.Error())
+			}
+		}
+	}
+
+	switch c["global"]["sslmode"] {
+	case "", "disable", "require", "verify-ca", "verify-full":
+	default:
+		problems = append(problems, "invalid sslmode "+c["global"]["sslmode"])
+	}
+	for _, key := range []string{"sslrootcert", "sslcert", "sslkey"} {
+		if c["global"][key] != "" {
+			_, err := os.Stat(c["global"][key])
+			if err != nil {
+				problems = append(problems, key+": "+err.Error())
+			}
+		}
+	}
+
+	switch c.getString("global", "readpolicy", "lag") {
+	case "lag", "roundrobin":
+	default:
+		problems = append(problems, "readpolicy must be lag or roundrobin, not "+c["global"]["readpolicy"])
+	}
+
+	switch c.getString("global", "patronimode", "replace") {
+	case "replace", "crosscheck":
+	default:
+		problems = append(problems, "patronimode must be replace or crosscheck, not "+c["global"]["patronimode"])
+	}
+	patroninames := []string{}
+	for name := range c["patroni"] {
+		patroninames = append(patroninames, name)
+	}
+	sort.Strings(patroninames)
+	for _, name := range patroninames {
+		if _, ok := c["servers"][name]; !ok {
+			problems = append(problems, "patroni configured for unknown server "+name)
+		}
+	}
+
+	if c["global"]["verifyconnstr"] != "" {
+		if _, err := normalizeConnStr(c["global"]["verifyconnstr"]); err != nil {
+			problems = append(problems, "verifyconnstr: "+err.Error())
+		}
+	}
+
+	// The connection and the queries must both fit within the timeout
+	// of every server, or it would always be the one hit first.
+	for _, key := range []string{"connecttimeout", "querytimeout"} {
+		if c["global"][key] == "" {
+			continue
+		}
+		timeout := c.getDuration("global", key, 0)
+		if timeout <= 0 {
+			problems = append(problems, "global."+key+" must be a positive number of seconds")
+			continue
+		}
+		if timeout >= c.getDuration("global", "timeout", 3*time.Second) {
+			problems = append(problems, "global."+key+" must be less than global.timeout")
+		}
+		for _, name := range names {
+			if c["timeouts"][name] != "" && timeout >= c.getDuration("timeouts", name, 0) {
+				problems = append(problems, "global."+key+" must be less than the timeout of server "+name)
+			}
+		}
+	}
+
+	if c["global"]["passfile"] != "" {
+		_, err := os.Stat(c["global"]["passfile"])
+		if err != nil {
+			problems = append(problems, "passfile: "+err.Error())
+		}
+	}
+
+	loglevel := strings.ToLower(c.getString("global", "loglevel", "info"))
+	if _, ok := logLevels[loglevel]; !ok || loglevel == "fatal" {
+		problems = append(problems, "loglevel must be debug, info, warn or error, not "+loglevel)
+	}
+
+	splitbrain := splitBrainMode(c)
+	if splitbrain != "none" && splitbrain != "priority" {
+		problems = append(problems, "splitbrain must be none or priority, not "+splitbrain)
+	}
+	prioritynames := []string{}
+	for name := range c["priorities"] {
+		prioritynames = append(prioritynames, name)
+	}
+	sort.Strings(prioritynames)
+	for _, name := range prioritynames {
+		if _, ok := c["servers"][name]; !ok {
+			problems = append(problems, "priority configured for unknown server "+name)
+		}
+		if _, err := strconv.ParseInt(c["priorities"][name], 10, 32); err != nil {
+			problems = append(problems, "priority for server "+name+" is not an integer")
+		}
+	}
+
+	maintenancenames := []string{}
+	for name := range c["maintenance"] {
+		maintenancenames = append(maintenancenames, name)
+	}
+	sort.Strings(maintenancenames)
+	for _, name := range maintenancenames {
+		if _, ok := c["servers"][name]; !ok {
+			problems = append(problems, "maintenance configured for unknown server "+name)
+		}
+	}
+
+	if c["global"]["pinned"] != "" {
+		if _, ok := c["servers"][c["global"]["pinned"]]; !ok {
+			problems = append(problems, "pinned server "+c["global"]["pinned"]+" is not configured")
+		}
+	}
+
+	if c["pushgateway"]["grouping"] != "" {
+		for _, label := range strings.Split(c["pushgateway"]["grouping"], ",") {
+			if !strings.Contains(label, "=") {
+				problems = append(problems, "pushgateway.grouping must be a comma separated list of name=value, not "+c["pushgateway"]["grouping"])
+				break
+			}
+		}
+	}
+
+	if ttl := c.getDuration("consul", "ttl", 30*time.Second); ttl < 10*time.Second || ttl > 24*time.Hour {
+		problems = append(problems, "consul.ttl must be between 10 and 86400 seconds")
+	}
+
+	if (c["http"]["username"] == "") != (c["http"]["password"] == "") {
+		problems = append(problems, "http.username and http.password must be set together")
+	}
+	if c["http"]["tlsclientca"] != "" && c["http"]["tlscert"] == "" {
+		problems = append(problems, "http.tlsclientca requires http.tlscert and http.tlskey")
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetDuration(t *testing.T) {
+	c := Config{"global": section{
+		"seconds":  "5",
+		"zero":     "0",
+		"duration": "1m30s",
+		"millis":   "250ms",
+		"invalid":  "soon",
+		"empty":    "",
+	}}
+	tests := []struct {
+		key      string
+		expected time.Duration
+	}{
+		{"seconds", 5 * time.Second},
+		{"zero", 0},
+		{"duration", 90 * time.Second},
+		{"millis", 250 * time.Millisecond},
+		{"invalid", time.Hour},
+		{"empty", time.Hour},
+		{"missing", time.Hour},
+	}
+	for _, test := range tests {
+		d := c.getDuration("global", test.key, time.Hour)
+		if d != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.key, d, test.expected)
+		}
+	}
+}
+
+func TestGetString(t *testing.T) {
+	c := Config{"global": section{"set": "value", "empty": ""}}
+	tests := []struct {
+		section  string
+		key      string
+		expected string
+	}{
+		{"global", "set", "value"},
+		{"global", "empty", ""},
+		{"global", "missing", "default"},
+		{"missing", "set", "default"},
+	}
+	for _, test := range tests {
+		s := c.getString(test.section, test.key, "default")
+		if s != test.expected {
+			t.Errorf("%s.%s: got %q, expected %q", test.section, test.key, s, test.expected)
+		}
+	}
+}
+
+func TestGetBool(t *testing.T) {
+	tests := []struct {
+		val      string
+		expected bool
+	}{
+		{"1", true},
+		{"true", true},
+		{"yes", true},
+		{"on", true},
+		{" On ", true},
+		{"TRUE", true},
+		{"0", false},
+		{"false", false},
+		{"no", false},
+		{"off", false},
+		{"NO", false},
+	}
+	for _, test := range tests {
+		// Use the opposite default, so we know the value was used
+		c := Config{"global": section{"key": test.val}}
+		b := c.getBool("global", "key", !test.expected)
+		if b != test.expected {
+			t.Errorf("%q: got %v, expected %v", test.val, b, test.expected)
+		}
+	}
+
+	// Anything else gives the default, whichever it is
+	for _, val := range []string{"", "maybe", "2", "enabled"} {
+		c := Config{"global": section{"key": val}}
+		if !c.getBool("global", "key", true) || c.getBool("global", "key", false) {
+			t.Errorf("%q: default not used", val)
+		}
+	}
+	if !(Config{}).getBool("global", "missing", true) {
+		t.Errorf("missing: default not used")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(c Config)
+		expected []string
+	}{
+		{"valid", func(c Config) {}, nil},
+		{"no pgbouncer", func(c Config) { delete(c["global"], "pgbouncer") }, []string{"global.pgbouncer is not set"}},
+		{"no symlink", func(c Config) { delete(c["global"], "symlink") }, []string{"global.symlink is not set"}},
+		{"no configdir", func(c Config) { delete(c["global"], "configdir") }, []string{"global.configdir is not set"}},
+		{"configdir missing", func(c Config) { c["global"]["configdir"] += "/missing" }, []string{"configdir: ", "server db1: ", "server db2: "}},
+		{"configdir not a directory", func(c Config) { c["global"]["configdir"] += "/db1.ini" }, []string{"is not a directory", "server db1: ", "server db2: "}},
+		{"symlink not writable", func(c Config) { c["global"]["symlink"] = "/nonexistent/pgbouncer.ini" }, []string{"directory of /nonexistent/pgbouncer.ini is not writable"}},
+		{"no servers", func(c Config) { delete(c, "servers") }, []string{"no servers configured"}},
+		{"empty connection string", func(c Config) { c["servers"]["db1"] = " " }, []string{"server db1 has an empty connection string"}},
+		{"invalid URI", func(c Config) { c["servers"]["db1"] = "postgres://db1:notaport/" }, []string{"server db1: invalid connection URI"}},
+		{"no pgbouncer config for server", func(c Config) { c["servers"]["db3"] = "host=db3" }, []string{"server db3: "}},
+		{"bouncer without connection string", func(c Config) { c["bouncers"] = section{"b1": ""} }, []string{"bouncer b1 has an empty connection string"}},
+		{"bouncer without symlink", func(c Config) {
+			c["bouncers"] = section{"b1": "fake"}
+			delete(c["global"], "symlink")
+		}, []string{"bouncer b1 has no symlink"}},
+		{"symlink for unknown bouncer", func(c Config) {
+			c["bouncers"] = section{"b1": "fake"}
+			c["symlinks"] = section{"b2": c["global"]["symlink"]}
+		}, []string{"symlink configured for unknown bouncer b2"}},
+		{"readsymlink without pgbouncer", func(c Config) {
+			c["bouncers"] = section{"b1": "fake"}
+			delete(c["global"], "pgbouncer")
+			c["global"]["readsymlink"] = c["global"]["symlink"] + ".read"
+		}, []string{"global.readsymlink is set, but neither"}},
+		{"invalid sslmode", func(c Config) { c["global"]["sslmode"] = "maybe" }, []string{"invalid sslmode maybe"}},
+		{"missing sslrootcert", func(c Config) { c["global"]["sslrootcert"] = "/nonexistent/root.crt" }, []string{"sslrootcert: "}},
+		{"unknown readpolicy", func(c Config) { c["global"]["readpolicy"] = "random" }, []string{"readpolicy must be lag or roundrobin, not random"}},
+		{"unknown patronimode", func(c Config) { c["global"]["patronimode"] = "ignore" }, []string{"patronimode must be replace or crosscheck, not ignore"}},
+		{"patroni for unknown server", func(c Config) { c["patroni"] = section{"db3": "http://db3:8008"} }, []string{"patroni configured for unknown server db3"}},
+		{"unknown splitbrain mode", func(c Config) { c["global"]["splitbrain"] = "random" }, []string{"splitbrain must be none or priority, not random"}},
+		{"priority for unknown server", func(c Config) { c["priorities"] = section{"db3": "1"} }, []string{"priority configured for unknown server db3"}},
+		{"priority not an integer", func(c Config) { c["priorities"] = section{"db1": "high"} }, []string{"priority for server db1 is not an integer"}},
+		{"bad connecttimeout", func(c Config) { c["global"]["connecttimeout"] = "soon" }, []string{"global.connecttimeout must be a positive number of seconds"}},
+		{"querytimeout too long", func(c Config) { c["global"]["querytimeout"] = "2s" }, []string{"global.querytimeout must be less than global.timeout"}},
+		{"connecttimeout longer than server timeout", func(c Config) {
+			c["global"]["connecttimeout"] = "500ms"
+			c["timeouts"] = section{"db2": "500ms"}
+		}, []string{"global.connecttimeout must be less than the timeout of server db2"}},
+		{"unknown loglevel", func(c Config) { c["global"]["loglevel"] = "fatal" }, []string{"loglevel must be debug, info, warn or error, not fatal"}},
+		{"maintenance for unknown server", func(c Config) { c["maintenance"] = section{"db3": "on"} }, []string{"maintenance configured for unknown server db3"}},
+		{"pinned to unknown server", func(c Config) { c["global"]["pinned"] = "db3" }, []string{"pinned server db3 is not configured"}},
+		{"bad pushgateway grouping", func(c Config) { c["pushgateway"] = section{"grouping": "site"} }, []string{"pushgateway.grouping must be a comma separated list"}},
+		{"bad consul ttl", func(c Config) { c["consul"] = section{"ttl": "5s"} }, []string{"consul.ttl must be between"}},
+		{"http password without username", func(c Config) { c["http"] = section{"password": "secret"} }, []string{"http.username and http.password must be set together"}},
+		{"http client CA without certificate", func(c Config) { c["http"] = section{"tlsclientca": "/etc/ca.crt"} }, []string{"http.tlsclientca requires http.tlscert"}},
+		{"missing passfile", func(c Config) { c["global"]["passfile"] = "/nonexistent/pgpass" }, []string{"passfile: "}},
+		{"template without output", func(c Config) { c["global"]["template"] = "/nonexistent/pgbouncer.ini.tmpl" }, []string{"global.output is not set", "template: "}},
+		{"every problem reported", func(c Config) {
+			delete(c["global"], "pgbouncer")
+			c["global"]["sslmode"] = "maybe"
+			c["global"]["splitbrain"] = "random"
+		}, []string{"global.pgbouncer is not set", "invalid sslmode maybe", "splitbrain must be none or priority"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := testConfig(t, "db1", "db2")
+			test.modify(c)
+			err := validateConfig(c)
+			if len(test.expected) == 0 {
+				if err != nil {
+					t.Errorf("valid configuration rejected: %s", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("invalid configuration accepted")
+			}
+			problems := strings.Split(err.Error(), "\n")
+			if len(problems) != len(test.expected) {
+				t.Errorf("got %d problems, expected %d: %s", len(problems), len(test.expected), err)
+			}
+			for _, expected := range test.expected {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("%q not reported in: %s", expected, err)
+				}
+			}
+		})
+	}
+}
+
+// Write configuration files to a temporary directory, and return the
+// path of the first one
+func writeConfigFiles(t *testing.T, files ...[2]string) string {
+	dir := t.TempDir()
+	for _, f := range files {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(dir, f[0])), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, f[0]), []byte(f[1]), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, files[0][0])
+}
+
+func TestReadConfigEnv(t *testing.T) {
+	t.Setenv("REBOUNCER_TEST_PASSWORD", "secret")
+	cfg, err := readConfig(writeConfigFiles(t, [2]string{"rebouncer.ini", "[servers]\ndb1=host=db1 password=${REBOUNCER_TEST_PASSWORD}\ndb2=host=db2 password=$REBOUNCER_TEST_PASSWORD\ndb3=host=db3 password=pa$$word\n"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := section{"db1": "host=db1 password=secret", "db2": "host=db2 password=secret", "db3": "host=db3 password=pa$word"}
+	if !reflect.DeepEqual(cfg["servers"], expected) {
+		t.Errorf("got %v, expected %v", cfg["servers"], expected)
+	}
+
+	_, err = readConfig(writeConfigFiles(t, [2]string{"rebouncer.ini", "[servers]\ndb1=host=db1\ndb2=password=${REBOUNCER_TEST_MISSING}\n"}))
+	if err == nil || !strings.Contains(err.Error(), "REBOUNCER_TEST_MISSING is not set on line 3") {
+		t.Errorf("missing variable not reported: %v", err)
+	}
+}
+
+func TestReadConfigInclude(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    [][2]string
+		expected Config
+		err      string
+	}{
+		{
+			name: "nested include",
+			files: [][2]string{
+				{"rebouncer.ini", "[global]\ninterval=10\ninclude=conf.d/servers.ini\n[http]\nport=8080\n"},
+				{"conf.d/servers.ini", "[servers]\ndb1=host=db1\ninclude=more.ini\n"},
+				{"conf.d/more.ini", "[servers]\ndb2=host=db2\n[global]\ninterval=20\n"},
+			},
+			expected: Config{
+				"global":  section{"interval": "20"},
+				"servers": section{"db1": "host=db1", "db2": "host=db2"},
+				"http":    section{"port": "8080"},
+			},
+		},
+		{
+			name: "included value overridden later",
+			files: [][2]string{
+				{"rebouncer.ini", "[global]\ninclude=defaults.ini\ninterval=5\n"},
+				{"defaults.ini", "[global]\ninterval=30\ntimeout=3\n"},
+			},
+			expected: Config{"global": section{"interval": "5", "timeout": "3"}},
+		},
+		{
+			name: "include cycle",
+			files: [][2]string{
+				{"rebouncer.ini", "[global]\ninclude=a.ini\n"},
+				{"a.ini", "[global]\ninclude=b.ini\n"},
+				{"b.ini", "[global]\ninclude=a.ini\n"},
+			},
+			err: "Include cycle detected",
+		},
+		{
+			name:  "include itself",
+			files: [][2]string{{"rebouncer.ini", "[global]\ninclude=rebouncer.ini\n"}},
+			err:   "Include cycle detected",
+		},
+		{
+			name:  "missing include",
+			files: [][2]string{{"rebouncer.ini", "[global]\ninclude=missing.ini\n"}},
+			err:   "Could not open configuration file",
+		},
+		{
+			name:  "duplicate key",
+			files: [][2]string{{"rebouncer.ini", "[global]\ninterval=10\ninterval=20\n"}},
+			err:   "Duplicate key interval in section [global] on line 3",
+		},
+		{
+			name:  "duplicate section",
+			files: [][2]string{{"rebouncer.ini", "[global]\ninterval=10\n[servers]\ndb1=host=db1\n[global]\ntimeout=3\n"}},
+			err:   "Duplicate section [global] on line 5",
+		},
+		{
+			name: "same section in included file",
+			files: [][2]string{
+				{"rebouncer.ini", "[servers]\ndb1=host=db1\ninclude=other.ini\n"},
+				{"other.ini", "[servers]\ndb1=host=db2\n"},
+			},
+			expected: Config{"servers": section{"db1": "host=db2"}},
+		},
+		{
+			name:  "missing equals sign",
+			files: [][2]string{{"rebouncer.ini", "[global]\ninterval\n"}},
+			err:   "Missing = sign on line 2",
+		},
+		{
+			name:  "value without section",
+			files: [][2]string{{"rebouncer.ini", "interval=10\n"}},
+			err:   "Config value without section on line 1",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := readConfig(writeConfigFiles(t, test.files...))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cfg, test.expected) {
+				t.Errorf("got %v, expected %v", cfg, test.expected)
+			}
+		})
+	}
+}
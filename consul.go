@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Publishes the master to a key in the Consul KV store, held by a
+// session that deletes the key when it expires.
+type consulStore struct {
+	session string
+}
+
+var consulPublisher = newMasterPublisher("consul", &consulStore{})
+
+func (c *consulStore) ttl() time.Duration {
+	return getConfig().getDuration("consul", "ttl", 30*time.Second)
+}
+
+// Make a request to the Consul HTTP API, returning the body of the
+// response.
+func (c *consulStore) request(method string, path string, body []byte) ([]byte, error) {
+	cfg := getConfig()
+	address := strings.TrimRight(cfg.getString("consul", "address", "http://127.0.0.1:8500"), "/")
+	req, err := http.NewRequest(method, address+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if token := cfg.getString("consul", "token", ""); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	client := &http.Client{Timeout: cfg.getDuration("global", "timeout", 3*time.Second)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respbody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(respbody)))
+	}
+	return respbody, nil
+}
+
+func (c *consulStore) keepalive() (bool, error) {
+	if c.session != "" {
+		_, err := c.request("PUT", "/v1/session/renew/"+c.session, nil)
+		return false, err
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"Name":     "rebouncer",
+		"TTL":      fmt.Sprintf("%ds", int(c.ttl().Seconds())),
+		"Behavior": "delete",
+	})
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.request("PUT", "/v1/session/create", body)
+	if err != nil {
+		return false, err
+	}
+	var session struct {
+		ID string
+	}
+	err = json.Unmarshal(resp, &session)
+	if err != nil {
+		return false, err
+	}
+	c.session = session.ID
+	return true, nil
+}
+
+func (c *consulStore) put(master string) error {
+	key := strings.TrimLeft(getConfig().getString("consul", "key", ""), "/")
+	resp, err := c.request("PUT", "/v1/kv/"+key+"?acquire="+url.QueryEscape(c.session), []byte(master))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(resp)) != "true" {
+		return fmt.Errorf("key %s is held by another session", key)
+	}
+	return nil
+}
+
+func (c *consulStore) reset() {
+	c.session = ""
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Database access used by the checks goes through these interfaces, so
+// that the real PostgreSQL driver can be replaced, for example with a
+// fake one for testing.
+
+// Opens connections to servers
+type Opener interface {
+	// Open a connection using the given connection string, and make
+	// sure it's alive before returning it. The timeout is used for
+	// establishing the connection, while the context can cancel it.
+	Open(ctx context.Context, connstr string, timeout time.Duration) (Conn, error)
+}
+
+// An open connection to a server. All queries are cancelled when
+// their context is.
+type Conn interface {
+	Query(ctx context.Context, query string, args ...interface{}) (Rows, error)
+	QueryRow(ctx context.Context, query string, args ...interface{}) Row
+	Exec(ctx context.Context, query string, args ...interface{}) error
+	Close() error
+}
+
+// A single row returned by Conn.QueryRow
+type Row interface {
+	Scan(dest ...interface{}) error
+}
+
+// A set of rows returned by Conn.Query
+type Rows interface {
+	// Return the database type name of each column
+	ColumnTypeNames() ([]string, error)
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+	Close() error
+}
+
+// Opener using lib/pq, used for all real servers
+type pqOpener struct{}
+
+var defaultOpener Opener = pqOpener{}
+
+func (o pqOpener) Open(ctx context.Context, connstr string, timeout time.Duration) (Conn, error) {
+	// Never go below one second, as zero means no timeout at all
+	connecttimeout := int(timeout.Seconds())
+	if connecttimeout < 1 {
+		connecttimeout = 1
+	}
+	db, err := sql.Open("postgres", fmt.Sprintf("%s connect_timeout=%d", connstr, connecttimeout))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxIdleConns(0)
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return pqConn{db}, nil
+}
+
+type pqConn struct {
+	db *sql.DB
+}
+
+func (c pqConn) Query(ctx context.Context, query string, args ...interface{}) (Rows, error) {
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pqRows{rows}, nil
+}
+
+func (c pqConn) QueryRow(ctx context.Context, query string, args ...interface{}) Row {
+	return c.db.QueryRowContext(ctx, query, args...)
+}
+
+func (c pqConn) Exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := c.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (c pqConn) Close() error {
+	return c.db.Close()
+}
+
+type pqRows struct {
+	*sql.Rows
+}
+
+func (r pqRows) ColumnTypeNames() ([]string, error) {
+	types, err := r.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = t.DatabaseTypeName()
+	}
+	return names, nil
+}
+
+// Convert a connection string in URI form (postgres://...) to the
+// key=value form, so that more settings can be appended to it. Other
+// connection strings are returned unchanged, except that brackets
+// around an IPv6 host address are removed, as lib/pq can't connect to
+// it with them.
+func normalizeConnStr(connstr string) (string, error) {
+	trimmed := strings.TrimSpace(connstr)
+	if !strings.HasPrefix(trimmed, "postgres://") && !strings.HasPrefix(trimmed, "postgresql://") {
+		return bracketedHostRegexp.ReplaceAllString(connstr, "${1}${2}${3}${4}"), nil
+	}
+	converted, err := pq.ParseURL(trimmed)
+	if err != nil {
+		return "", fmt.Errorf("invalid connection URI: %s", maskPassword(err.Error()))
+	}
+	// lib/pq only removes the brackets around an IPv6 address when
+	// there is a port as well.
+	return bracketedHostRegexp.ReplaceAllString(converted, "${1}${2}${3}${4}"), nil
+}
+
+// A bracketed IPv6 address in the host of a key=value connection string,
+// which may also be quoted, as lib/pq does when converting a URI
+var bracketedHostRegexp = regexp.MustCompile(`(^|\s)(host\s*=\s*)(?:'\[([0-9A-Fa-f:.]+(?:%[^\]\s']+)?)\]'|\[([0-9A-Fa-f:.]+(?:%[^\]\s']+)?)\])`)
+
+// TLS settings in the global section that are added to the connection
+// string of every server that doesn't set them itself
+var tlsSettings = []string{"sslmode", "sslrootcert", "sslcert", "sslkey"}
+
+// Check if a key/value connection string sets the given key
+func connStrHasKey(connstr string, key string) bool {
+	return regexp.MustCompile(`(^|\s)` + regexp.QuoteMeta(key) + `\s*=`).MatchString(connstr)
+}
+
+// Return the value of a key in a key/value connection string, with any
+// quoting and backslash escapes removed, or an empty string if it's not
+// set. If the key is set more than once, the last one wins, as in libpq.
+func connStrValue(connstr string, key string) string {
+	matches := regexp.MustCompile(`(?:^|\s)`+regexp.QuoteMeta(key)+`\s*=\s*('(?:[^'\\]|\\.)*'|(?:[^\s'\\]|\\.)+)`).FindAllStringSubmatch(connstr, -1)
+	if len(matches) == 0 {
+		return ""
+	}
+	val := matches[len(matches)-1][1]
+	if strings.HasPrefix(val, "'") {
+		val = val[1 : len(val)-1]
+	}
+	return regexp.MustCompile(`\\(.)`).ReplaceAllString(val, "$1")
+}
+
+// Add the TLS settings from the global section to a key/value
+// connection string, except for the ones it already sets.
+func addTLSDefaults(c Config, connstr string) string {
+	for _, key := range tlsSettings {
+		if c["global"][key] != "" && !connStrHasKey(connstr, key) {
+			connstr = fmt.Sprintf("%s %s=%s", connstr, key, quoteConnValue(c["global"][key]))
+		}
+	}
+	return connstr
+}
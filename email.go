@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Sends email through the server in the smtp section when there is no
+// usable master or more than one, and when there is a single master
+// again.
+type emailNotifier struct {
+	host string
+}
+
+func (e emailNotifier) OnFailover(ctx context.Context, failoverid string, oldmaster string, newmaster string) {
+}
+
+func (e emailNotifier) OnNoMaster(servers []Server) {
+	go e.send("rebouncer: no master available", servers)
+}
+
+func (e emailNotifier) OnSplitBrain(masters []string, servers []Server) {
+	go e.send(fmt.Sprintf("rebouncer: more than one master (%s)", strings.Join(masters, ", ")), servers)
+}
+
+func (e emailNotifier) OnCanaryFailed(masters []string, servers []Server) {
+	go e.send(fmt.Sprintf("rebouncer: canary query failing on master (%s)", strings.Join(masters, ", ")), servers)
+}
+
+func (e emailNotifier) OnRecovered(master string, servers []Server) {
+	go e.send(fmt.Sprintf("rebouncer: master %s available again", master), servers)
+}
+
+func (e emailNotifier) OnBouncerUnreachable(attempts int) {
+	go e.send(fmt.Sprintf("rebouncer: can't reach pgbouncer at startup, %d attempts failed", attempts), nil)
+}
+
+// Send one email, with the status of all servers in the body. Failures
+// are logged.
+func (e emailNotifier) send(subject string, servers []Server) {
+	cfg := getConfig()
+	from := cfg.getString("smtp", "from", "rebouncer@localhost")
+	to := []string{}
+	for _, addr := range strings.Split(cfg.getString("smtp", "to", ""), ",") {
+		if strings.TrimSpace(addr) != "" {
+			to = append(to, strings.TrimSpace(addr))
+		}
+	}
+	if len(to) == 0 {
+		logError("smtp: no recipients configured, not sending \"%s\"", subject)
+		return
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\nNode status:\r\n", subject)
+	for _, s := range servers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", s.name, s.status)
+	}
+
+	err := e.deliver(from, to, msg.Bytes())
+	if err != nil {
+		logError("smtp: failed to send \"%s\": %s", subject, err)
+	}
+}
+
+// Deliver a message over SMTP. This is smtp.SendMail, except with a
+// timeout on the connection so an unreachable server doesn't leave us
+// hanging.
+func (e emailNotifier) deliver(from string, to []string, msg []byte) error {
+	cfg := getConfig()
+	timeout := cfg.getDuration("global", "timeout", 3*time.Second)
+	addr := net.JoinHostPort(e.host, cfg.getString("smtp", "port", "25"))
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout * 3))
+
+	c, err := smtp.NewClient(conn, e.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: e.host})
+		if err != nil {
+			return err
+		}
+	}
+	if username := cfg.getString("smtp", "username", ""); username != "" {
+		err = c.Auth(smtp.PlainAuth("", username, cfg.getString("smtp", "password", ""), e.host))
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Mail(from)
+	if err != nil {
+		return err
+	}
+	for _, addr := range to {
+		err = c.Rcpt(addr)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Publishes the master to a key in etcd, using the JSON gateway of the
+// v3 API. The key is attached to a lease, so it is removed when the
+// lease expires.
+type etcdStore struct {
+	lease string
+}
+
+var etcdPublisher = newMasterPublisher("etcd", &etcdStore{})
+
+func (e *etcdStore) ttl() time.Duration {
+	return getConfig().getDuration("etcd", "ttl", 30*time.Second)
+}
+
+// Return an http client for talking to etcd, using TLS client
+// certificates and a custom CA if configured.
+func etcdClient() (*http.Client, error) {
+	cfg := getConfig()
+	client := &http.Client{Timeout: cfg.getDuration("global", "timeout", 3*time.Second)}
+
+	tlsconfig := &tls.Config{}
+	certfile := cfg.getString("etcd", "clientcert", "")
+	keyfile := cfg.getString("etcd", "clientkey", "")
+	if certfile != "" || keyfile != "" {
+		cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+		if err != nil {
+			return nil, err
+		}
+		tlsconfig.Certificates = []tls.Certificate{cert}
+	}
+	if cafile := cfg.getString("etcd", "cacert", ""); cafile != "" {
+		pem, err := os.ReadFile(cafile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + cafile)
+		}
+		tlsconfig.RootCAs = pool
+	}
+	client.Transport = &http.Transport{TLSClientConfig: tlsconfig}
+	return client, nil
+}
+
+// Post a request to the first etcd endpoint that answers, decoding the
+// response into result.
+func (e *etcdStore) request(path string, body interface{}, result interface{}) error {
+	client, err := etcdClient()
+	if err != nil {
+		return err
+	}
+	reqbody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	for _, endpoint := range strings.Split(getConfig().getString("etcd", "endpoints", "http://127.0.0.1:2379"), ",") {
+		endpoint = strings.TrimRight(strings.TrimSpace(endpoint), "/")
+		var resp *http.Response
+		resp, err = client.Post(endpoint+path, "application/json", bytes.NewReader(reqbody))
+		if err != nil {
+			continue
+		}
+		var respbody []byte
+		respbody, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %s from %s: %s", resp.Status, endpoint, strings.TrimSpace(string(respbody)))
+		}
+		return json.Unmarshal(respbody, result)
+	}
+	return err
+}
+
+func (e *etcdStore) keepalive() (bool, error) {
+	if e.lease != "" {
+		var resp struct {
+			Result struct {
+				TTL string
+			}
+		}
+		err := e.request("/v3/lease/keepalive", map[string]string{"ID": e.lease}, &resp)
+		if err != nil {
+			return false, err
+		}
+		// An expired lease is reported without a TTL
+		if resp.Result.TTL == "" || resp.Result.TTL == "0" {
+			return false, fmt.Errorf("lease %s has expired", e.lease)
+		}
+		return false, nil
+	}
+
+	var resp struct {
+		ID    string
+		Error string
+	}
+	err := e.request("/v3/lease/grant", map[string]int64{"TTL": int64(e.ttl().Seconds())}, &resp)
+	if err != nil {
+		return false, err
+	}
+	if resp.ID == "" {
+		return false, fmt.Errorf("could not grant lease: %s", resp.Error)
+	}
+	e.lease = resp.ID
+	return true, nil
+}
+
+func (e *etcdStore) put(master string) error {
+	var resp struct{}
+	return e.request("/v3/kv/put", map[string]string{
+		"key":   base64.StdEncoding.EncodeToString([]byte(getConfig().getString("etcd", "key", ""))),
+		"value": base64.StdEncoding.EncodeToString([]byte(master)),
+		"lease": e.lease,
+	}, &resp)
+}
+
+func (e *etcdStore) reset() {
+	e.lease = ""
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State a fake server reports in one check
+type fakeState struct {
+	status Status
+	lag    time.Duration
+
+	// Fail any query mentioning a canary
+	canaryfails bool
+}
+
+// Opener for fake servers, identified by the host in the connection
+// string. Each check of a server returns the next state from its script,
+// and once the script runs out the last state is repeated.
+type fakeOpener struct {
+	mu      sync.Mutex
+	scripts map[string][]fakeState
+	checks  map[string]int
+}
+
+func newFakeOpener(scripts map[string][]fakeState) *fakeOpener {
+	return &fakeOpener{scripts: scripts, checks: make(map[string]int)}
+}
+
+// Return the number of polls made so far, which is the highest number
+// of checks of any one server.
+func (o *fakeOpener) polls() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	polls := 0
+	for _, n := range o.checks {
+		if n > polls {
+			polls = n
+		}
+	}
+	return polls
+}
+
+func (o *fakeOpener) Open(ctx context.Context, connstr string, timeout time.Duration) (Conn, error) {
+	host := connStrValue(connstr, "host")
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	script, ok := o.scripts[host]
+	if !ok || len(script) == 0 {
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	o.checks[host]++
+	state := script[len(script)-1]
+	if o.checks[host] <= len(script) {
+		state = script[o.checks[host]-1]
+	}
+	if state.status == DOWN {
+		return nil, errors.New("connection refused")
+	}
+	return fakeConn{state}, nil
+}
+
+type fakeConn struct {
+	state fakeState
+}
+
+func (c fakeConn) Query(ctx context.Context, query string, args ...interface{}) (Rows, error) {
+	if c.state.canaryfails && strings.Contains(query, "canary") {
+		return nil, errors.New("relation \"canary\" does not exist")
+	}
+	return &fakeRows{types: []string{"BOOL"}, values: []interface{}{c.state.status == MASTER}}, nil
+}
+
+func (c fakeConn) QueryRow(ctx context.Context, query string, args ...interface{}) Row {
+	switch {
+	case query == "SHOW server_version_num":
+		return fakeRow{160000}
+	case query == "SHOW transaction_read_only":
+		return fakeRow{"off"}
+	case strings.Contains(query, "clock_timestamp()"):
+		return fakeRow{float64(time.Now().UnixNano()) / float64(time.Second)}
+	case strings.Contains(query, "pg_last_xact_replay_timestamp()"):
+		return fakeRow{c.state.lag.Seconds()}
+	}
+	return fakeRow{errors.New("unexpected query: " + query)}
+}
+
+func (c fakeConn) Exec(ctx context.Context, query string, args ...interface{}) error {
+	return nil
+}
+
+func (c fakeConn) Close() error {
+	return nil
+}
+
+// A single row with a single value, or the error to return from Scan
+type fakeRow struct {
+	value interface{}
+}
+
+func (r fakeRow) Scan(dest ...interface{}) error {
+	return scanFakeValues(dest, []interface{}{r.value})
+}
+
+// A single row with the given column types and values
+type fakeRows struct {
+	types  []string
+	values []interface{}
+	done   bool
+}
+
+func (r *fakeRows) ColumnTypeNames() ([]string, error) {
+	return r.types, nil
+}
+
+func (r *fakeRows) Next() bool {
+	if r.done {
+		return false
+	}
+	r.done = true
+	return true
+}
+
+func (r *fakeRows) Scan(dest ...interface{}) error {
+	return scanFakeValues(dest, r.values)
+}
+
+func (r *fakeRows) Err() error {
+	return nil
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func scanFakeValues(dest []interface{}, values []interface{}) error {
+	if len(values) == 1 {
+		if err, ok := values[0].(error); ok {
+			return err
+		}
+	}
+	if len(dest) != len(values) {
+		return fmt.Errorf("expected %d destinations, got %d", len(values), len(dest))
+	}
+	for i, v := range values {
+		switch d := dest[i].(type) {
+		case *bool:
+			*d = v.(bool)
+		case *int:
+			*d = v.(int)
+		case *float64:
+			*d = v.(float64)
+		case *string:
+			*d = v.(string)
+		default:
+			return fmt.Errorf("can't scan into %T", dest[i])
+		}
+	}
+	return nil
+}
+
+// A fake pgbouncer, registered as a database/sql driver so it can be
+// used in place of the real one by setting bouncerDriver. It accepts
+// any connection, and records when it is reloaded. The connection
+// string is only used to tell instances apart.
+type fakeBouncerDriver struct {
+	mu       sync.Mutex
+	reloads  []time.Time
+	onReload func()
+
+	// Instances where RELOAD fails
+	broken map[string]bool
+}
+
+var fakeBouncer = &fakeBouncerDriver{}
+
+func init() {
+	sql.Register("fakebouncer", fakeBouncer)
+}
+
+// Forget all earlier reloads, and call onReload on every new one
+func (d *fakeBouncerDriver) reset(onReload func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.reloads = nil
+	d.onReload = onReload
+	d.broken = make(map[string]bool)
+}
+
+// Make RELOAD fail on the instance with the given connection string
+func (d *fakeBouncerDriver) breakReload(connstr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.broken[connstr] = true
+}
+
+// Return the times of all reloads since the last reset
+func (d *fakeBouncerDriver) reloadTimes() []time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]time.Time{}, d.reloads...)
+}
+
+func (d *fakeBouncerDriver) Open(name string) (driver.Conn, error) {
+	return fakeBouncerConn{d, name}, nil
+}
+
+type fakeBouncerConn struct {
+	driver  *fakeBouncerDriver
+	connstr string
+}
+
+func (c fakeBouncerConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements not supported by pgbouncer")
+}
+
+func (c fakeBouncerConn) Close() error {
+	return nil
+}
+
+func (c fakeBouncerConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported by pgbouncer")
+}
+
+func (c fakeBouncerConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if query == "RELOAD" {
+		c.driver.mu.Lock()
+		if c.driver.broken[c.connstr] {
+			c.driver.mu.Unlock()
+			return nil, errors.New("RELOAD failed")
+		}
+		c.driver.reloads = append(c.driver.reloads, time.Now())
+		onReload := c.driver.onReload
+		c.driver.mu.Unlock()
+		if onReload != nil {
+			onReload()
+		}
+	}
+	return driver.RowsAffected(0), nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Extra fields to include in structured log output, such as the server
+// a message is about. They are left out of text output, where the
+// message itself already contains them.
+type logFields map[string]string
+
+type logger struct {
+	fields logFields
+}
+
+// Return a logger that adds the given fields to everything it logs
+func withFields(fields logFields) logger {
+	return logger{fields}
+}
+
+// Prefixes used for the levels in text output
+var logPrefixes = map[string]string{
+	"debug": "DEBUG: ",
+	"warn":  "WARNING: ",
+	"error": "ERROR: ",
+}
+
+// Log levels in increasing order of severity. Messages below the
+// configured loglevel are not logged.
+var logLevels = map[string]int{
+	"debug": 0,
+	"info":  1,
+	"warn":  2,
+	"error": 3,
+	"fatal": 4,
+}
+
+// If set, log messages are sent here instead of to the log package
+var syslogOutput func(level string, msg string)
+
+// Write one log message in the configured format, either text or one
+// JSON object per line.
+func (l logger) output(level string, format string, args ...interface{}) {
+	minlevel, ok := logLevels[strings.ToLower(getConfig().getString("global", "loglevel", "info"))]
+	if !ok {
+		minlevel = logLevels["info"]
+	}
+	if logLevels[level] < minlevel {
+		return
+	}
+
+	msg := fmt.Sprintf(format, args...)
+
+	if getConfig().getString("global", "logformat", "text") != "json" {
+		if syslogOutput != nil {
+			// syslog has its own priorities
+			syslogOutput(level, msg)
+			return
+		}
+		log.Print(logPrefixes[level] + msg)
+		return
+	}
+
+	entry := make(map[string]string)
+	for k, v := range l.fields {
+		entry[k] = v
+	}
+	entry["ts"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["msg"] = msg
+	b, _ := json.Marshal(entry)
+	if syslogOutput != nil {
+		syslogOutput(level, string(b))
+		return
+	}
+	// The timestamp is part of the object, so don't let the log
+	// package add one.
+	log.New(log.Writer(), "", 0).Print(string(b))
+}
+
+func (l logger) Debug(format string, args ...interface{}) {
+	l.output("debug", format, args...)
+}
+
+func (l logger) Info(format string, args ...interface{}) {
+	l.output("info", format, args...)
+}
+
+func (l logger) Warn(format string, args ...interface{}) {
+	l.output("warn", format, args...)
+}
+
+func (l logger) Error(format string, args ...interface{}) {
+	l.output("error", format, args...)
+}
+
+func logDebug(format string, args ...interface{}) {
+	logger{}.Debug(format, args...)
+}
+
+func logInfo(format string, args ...interface{}) {
+	logger{}.Info(format, args...)
+}
+
+func logWarn(format string, args ...interface{}) {
+	logger{}.Warn(format, args...)
+}
+
+func logError(format string, args ...interface{}) {
+	logger{}.Error(format, args...)
+}
+
+// Log an error that we can't continue after, and exit
+func logFatal(format string, args ...interface{}) {
+	logger{}.output("fatal", format, args...)
+	os.Exit(1)
+}
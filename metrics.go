@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Registry holding all metrics exposed on /metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+var failoversTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "rebouncer_failovers_total",
+	Help: "Number of attempts at reconfiguring pgbouncer for a new master.",
+})
+
+var checkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "rebouncer_check_duration_seconds",
+	Help:    "Time taken by completed checks of each server.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"server"})
+
+var checkTimeoutsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "rebouncer_check_timeouts_total",
+	Help: "Number of checks of each server that timed out.",
+}, []string{"server"})
+
+var (
+	serverStatusDesc = prometheus.NewDesc(
+		"rebouncer_server_status",
+		"Status of each server (0=down, 1=standby, 2=master, 3=maintenance).",
+		[]string{"server"}, nil)
+	lastCheckDesc = prometheus.NewDesc(
+		"rebouncer_last_check_timestamp_seconds",
+		"Time of the last completed check of each server.",
+		[]string{"server"}, nil)
+	serverVersionDesc = prometheus.NewDesc(
+		"rebouncer_server_version",
+		"PostgreSQL server_version_num of each server, 0 if unknown.",
+		[]string{"server"}, nil)
+	sinceFailoverDesc = prometheus.NewDesc(
+		"rebouncer_time_since_last_failover_seconds",
+		"Time since pgbouncer was last reconfigured for a new master.",
+		nil, nil)
+)
+
+// Collector exposing the per-server status and the time since the last
+// failover. It is pulled from the status collector on every scrape, so
+// there is no separate state to keep in sync.
+type serverCollector struct{}
+
+func (c serverCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- serverStatusDesc
+	ch <- lastCheckDesc
+	ch <- serverVersionDesc
+	ch <- sinceFailoverDesc
+}
+
+func (c serverCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), getConfig().getDuration("global", "timeout", 3*time.Second))
+	defer cancel()
+	snapshot, err := getSnapshot(ctx)
+	if err != nil {
+		// Leave out the per-server metrics rather than hang the scrape
+		logWarn("Could not get server status for metrics: %s", err)
+		return
+	}
+	for _, s := range snapshot.servers {
+		ch <- prometheus.MustNewConstMetric(serverStatusDesc, prometheus.GaugeValue, float64(s.status), s.name)
+		if !s.lastcheck.IsZero() {
+			ch <- prometheus.MustNewConstMetric(lastCheckDesc, prometheus.GaugeValue, float64(s.lastcheck.UnixNano())/1e9, s.name)
+		}
+		ch <- prometheus.MustNewConstMetric(serverVersionDesc, prometheus.GaugeValue, float64(s.version), s.name)
+	}
+	if !snapshot.lastfailover.IsZero() {
+		ch <- prometheus.MustNewConstMetric(sinceFailoverDesc, prometheus.GaugeValue, time.Since(snapshot.lastfailover).Seconds())
+	}
+}
+
+func init() {
+	metricsRegistry.MustRegister(failoversTotal)
+	metricsRegistry.MustRegister(checkDuration)
+	metricsRegistry.MustRegister(checkTimeoutsTotal)
+	metricsRegistry.MustRegister(serverCollector{})
+}
+
+// Return the http handler for the /metrics endpoint
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// Set up a pusher for the Pushgateway in the pushgateway section, or
+// return nil if none is configured
+func newPusher(cfg Config) *push.Pusher {
+	url := cfg.getString("pushgateway", "url", "")
+	if url == "" {
+		return nil
+	}
+
+	pusher := push.New(url, cfg.getString("pushgateway", "job", "rebouncer")).Gatherer(metricsRegistry)
+	grouping := cfg.getString("pushgateway", "grouping", "")
+	if grouping == "" {
+		// Keep several rebouncers from overwriting each other
+		hostname, _ := os.Hostname()
+		grouping = "instance=" + hostname
+	}
+	for _, label := range strings.Split(grouping, ",") {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) == 2 {
+			pusher = pusher.Grouping(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		}
+	}
+	return pusher
+}
+
+// Return the time between pushes to the Pushgateway
+func pushInterval(cfg Config) time.Duration {
+	interval := cfg.getDuration("pushgateway", "interval", cfg.getDuration("global", "interval", 30*time.Second))
+	if interval <= 0 {
+		return 30 * time.Second
+	}
+	return interval
+}
+
+// Push the metrics to the Prometheus Pushgateway in the pushgateway
+// section every interval, until the context is cancelled. The
+// configuration is read again before every push, so a reload can
+// change, enable or disable it. Failures are only logged, and the
+// push is retried at the next interval.
+func runPushgateway(ctx context.Context) {
+	timer := time.NewTimer(pushInterval(getConfig()))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+		cfg := getConfig()
+		timer.Reset(pushInterval(cfg))
+
+		pusher := newPusher(cfg)
+		if pusher == nil {
+			continue
+		}
+		err := pusher.PushContext(ctx)
+		if err != nil && ctx.Err() == nil {
+			logWarn("could not push metrics to pushgateway: %s", maskPassword(err.Error()))
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	before := testutil.ToFloat64(failoversTotal)
+	cfg := testConfig(t, "db1", "db2")
+	_, snapshot := runMainloop(t, cfg, map[string][]fakeState{"db1": {up, down}, "db2": {standby, up}}, 3)
+	if failovers := testutil.ToFloat64(failoversTotal) - before; failovers != 2 {
+		t.Errorf("rebouncer_failovers_total increased by %v, expected 2", failovers)
+	}
+
+	// Scrape with the state as of the last poll
+	statuschan := startStatusCollector(t)
+	statuschan <- snapshot
+
+	rec := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	metrics := rec.Body.String()
+	for _, expected := range []string{
+		`rebouncer_server_status{server="db1"} 0`,
+		`rebouncer_server_status{server="db2"} 2`,
+		`rebouncer_server_version{server="db1"} 160000`,
+		`rebouncer_server_version{server="db2"} 160000`,
+		`rebouncer_last_check_timestamp_seconds{server="db1"} `,
+		`rebouncer_last_check_timestamp_seconds{server="db2"} `,
+		`rebouncer_time_since_last_failover_seconds `,
+		`rebouncer_failovers_total `,
+		`rebouncer_check_duration_seconds_count{server="db2"} `,
+	} {
+		if !strings.Contains(metrics, "\n"+expected) {
+			t.Errorf("%s not found in metrics:\n%s", expected, metrics)
+		}
+	}
+}
+
+func TestPushgateway(t *testing.T) {
+	type pushRequest struct {
+		path string
+		body string
+	}
+	requests := make(chan pushRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- pushRequest{r.URL.Path, string(body)}
+	}))
+	defer server.Close()
+
+	statuschan := startStatusCollector(t)
+	statuschan <- Snapshot{servers: []Server{{name: "db1", status: MASTER}}}
+
+	cfg := Config{
+		"global":      section{"timeout": "1s"},
+		"pushgateway": section{"url": server.URL, "grouping": "instance=test", "interval": "10ms"},
+	}
+	setConfig(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		runPushgateway(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Wait for a push to the given path
+	waitForPush := func(path string) pushRequest {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case req := <-requests:
+				if req.path == path {
+					return req
+				}
+			case <-timeout:
+				t.Fatalf("no push to %s", path)
+			}
+		}
+	}
+	req := waitForPush("/metrics/job/rebouncer/instance/test")
+	if !strings.Contains(req.body, "rebouncer_server_status") {
+		t.Errorf("pushed metrics lack rebouncer_server_status")
+	}
+
+	// A changed configuration is used for the next push
+	newcfg := cfg.clone()
+	newcfg["pushgateway"]["job"] = "other"
+	setConfig(newcfg)
+	waitForPush("/metrics/job/other/instance/test")
+}
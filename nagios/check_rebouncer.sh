@@ -20,6 +20,11 @@ if [[ $DATA == CRITICAL* ]]; then
    exit 2
 fi
 
+if [[ $DATA == UNKNOWN* ]]; then
+   echo $DATA
+   exit 3
+fi
+
 echo $DATA
 exit 0
 
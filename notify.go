@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// How long to wait for the output of a command to be closed after it
+// has exited or been killed
+const commandWaitDelay = 100 * time.Millisecond
+
+// Run an external command with a timeout, returning its combined
+// output. Any extra environment variables in env are added to the
+// environment of rebouncer itself.
+func runCommand(command string, env []string, timeout time.Duration, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	// Only the command itself is killed on timeout, so don't wait for
+	// anything it started that still holds on to its output.
+	cmd.WaitDelay = commandWaitDelay
+	out, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
+
+// Run an external notification command, logging any output and
+// failures. Runs synchronously, so callers that must not block should
+// run it on a goroutine of its own.
+func runNotifyCommand(command string, args ...string) {
+	timeout := getConfig().getDuration("global", "timeout", 3*time.Second)
+	out, err := runCommand(command, nil, timeout, args...)
+	if out != "" {
+		logInfo("%s: %s", command, out)
+	}
+	if err != nil {
+		logError("notification command %s failed: %s", command, err)
+	}
+}
+
+// Run the node up/down commands when a server changes between being
+// down and being up. To keep a flapping node from spamming the
+// commands, a change is only reported once the previous report for the
+// same node is at least node_command_debounce seconds old, and a node
+// that flaps back within that window is not reported at all.
+func notifyNodeState(server *Server) {
+	down := server.status == DOWN
+	if !server.hookinit {
+		// First check of this node, so there is no transition
+		// to report.
+		server.hookinit = true
+		server.hookdown = down
+		return
+	}
+	if down == server.hookdown {
+		return
+	}
+	debounce := getConfig().getDuration("notify", "node_command_debounce", 60*time.Second)
+	if time.Since(server.hooktime) < debounce {
+		return
+	}
+	server.hookdown = down
+	server.hooktime = time.Now()
+
+	command := getConfig()["notify"]["node_up_command"]
+	if down {
+		command = getConfig()["notify"]["node_down_command"]
+	}
+	if command != "" {
+		go runNotifyCommand(command, server.name, server.status.String())
+	}
+}
+
+// A backend that is told about failovers and changes in the state of
+// the cluster as a whole. Implementations must not block, since they
+// are called from the main loop.
+type Notifier interface {
+	// pgbouncer has been reconfigured for a new master. The context
+	// carries the trace of the failover, if tracing is enabled.
+	OnFailover(ctx context.Context, failoverid string, oldmaster string, newmaster string)
+
+	// No server reports being master
+	OnNoMaster(servers []Server)
+
+	// More than one server reports being master
+	OnSplitBrain(masters []string, servers []Server)
+
+	// The canary query is failing on all servers reporting being
+	// master, and master_canary_failover is enabled
+	OnCanaryFailed(masters []string, servers []Server)
+
+	// There is exactly one master again, after having had none, more
+	// than one or only ones failing the canary query
+	OnRecovered(master string, servers []Server)
+
+	// pgbouncer could not be reached in the given number of attempts
+	// while starting up
+	OnBouncerUnreachable(attempts int)
+}
+
+// Passes every event on to a number of other notifiers
+type multiNotifier []Notifier
+
+func (m multiNotifier) OnFailover(ctx context.Context, failoverid string, oldmaster string, newmaster string) {
+	for _, n := range m {
+		n.OnFailover(ctx, failoverid, oldmaster, newmaster)
+	}
+}
+
+func (m multiNotifier) OnNoMaster(servers []Server) {
+	for _, n := range m {
+		n.OnNoMaster(servers)
+	}
+}
+
+func (m multiNotifier) OnSplitBrain(masters []string, servers []Server) {
+	for _, n := range m {
+		n.OnSplitBrain(masters, servers)
+	}
+}
+
+func (m multiNotifier) OnCanaryFailed(masters []string, servers []Server) {
+	for _, n := range m {
+		n.OnCanaryFailed(masters, servers)
+	}
+}
+
+func (m multiNotifier) OnRecovered(master string, servers []Server) {
+	for _, n := range m {
+		n.OnRecovered(master, servers)
+	}
+}
+
+func (m multiNotifier) OnBouncerUnreachable(attempts int) {
+	for _, n := range m {
+		n.OnBouncerUnreachable(attempts)
+	}
+}
+
+// Return a notifier passing events on to all notifiers that are
+// enabled in the configuration. The ones posting messages for people
+// to read are debounced.
+func getNotifiers() Notifier {
+	cfg := getConfig()
+	notifiers := multiNotifier{}
+	if url := cfg.getString("notify", "webhook", ""); url != "" {
+		notifiers = append(notifiers, webhookNotifier{url})
+	}
+	if url := cfg.getString("notify", "slack_webhook", ""); url != "" {
+		notifiers = append(notifiers, debounce("slack", slackNotifier{url}))
+	}
+	if key := cfg.getString("pagerduty", "routing_key", ""); key != "" {
+		notifiers = append(notifiers, pagerDutyNotifier{key})
+	}
+	if host := cfg.getString("smtp", "host", ""); host != "" {
+		notifiers = append(notifiers, debounce("smtp", emailNotifier{host}))
+	}
+	if cfg.getString("statsd", "host", "") != "" {
+		notifiers = append(notifiers, statsdNotifier{})
+	}
+	if cfg.getString("consul", "key", "") != "" {
+		notifiers = append(notifiers, publishNotifier{consulPublisher})
+	}
+	if cfg.getString("etcd", "key", "") != "" {
+		notifiers = append(notifiers, publishNotifier{etcdPublisher})
+	}
+	return notifiers
+}
+
+// Time each kind of alert was last sent by each debounced notifier.
+// Only used from the main loop.
+var alertSent = make(map[string]time.Time)
+
+// A notifier that doesn't repeat the same kind of alert about the state
+// of the cluster within alert_debounce seconds, so a flapping cluster
+// doesn't spam people. Failovers and recoveries are always passed on,
+// so nobody is left believing the cluster is still broken.
+type debouncedNotifier struct {
+	name     string
+	notifier Notifier
+}
+
+func debounce(name string, n Notifier) Notifier {
+	return debouncedNotifier{name, n}
+}
+
+// Check if an alert of the given kind may be sent now, and if so
+// record that it is.
+func (d debouncedNotifier) allow(kind string) bool {
+	key := d.name + "/" + kind
+	if time.Since(alertSent[key]) < getConfig().getDuration("notify", "alert_debounce", 300*time.Second) {
+		return false
+	}
+	alertSent[key] = time.Now()
+	return true
+}
+
+func (d debouncedNotifier) OnFailover(ctx context.Context, failoverid string, oldmaster string, newmaster string) {
+	d.notifier.OnFailover(ctx, failoverid, oldmaster, newmaster)
+}
+
+func (d debouncedNotifier) OnNoMaster(servers []Server) {
+	if d.allow("nomaster") {
+		d.notifier.OnNoMaster(servers)
+	}
+}
+
+func (d debouncedNotifier) OnSplitBrain(masters []string, servers []Server) {
+	if d.allow("splitbrain") {
+		d.notifier.OnSplitBrain(masters, servers)
+	}
+}
+
+func (d debouncedNotifier) OnCanaryFailed(masters []string, servers []Server) {
+	if d.allow("canaryfailed") {
+		d.notifier.OnCanaryFailed(masters, servers)
+	}
+}
+
+func (d debouncedNotifier) OnRecovered(master string, servers []Server) {
+	d.notifier.OnRecovered(master, servers)
+}
+
+func (d debouncedNotifier) OnBouncerUnreachable(attempts int) {
+	if d.allow("bouncer") {
+		d.notifier.OnBouncerUnreachable(attempts)
+	}
+}
+
+// Post a JSON document to a webhook, retrying once on failure. The
+// description is used to log failures.
+func postWebhook(description string, url string, body []byte) {
+	client := &http.Client{
+		Timeout: getConfig().getDuration("global", "timeout", 3*time.Second),
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		logError("%s delivery to %s failed: %s", description, maskPassword(url), maskPassword(err.Error()))
+	}
+}
+
+// Payload posted to the webhook when the master changes
+type webhookEvent struct {
+	Event     string `json:"event"`
+	Id        string `json:"id"`
+	Old       string `json:"old"`
+	New       string `json:"new"`
+	Timestamp string `json:"timestamp"`
+	TraceId   string `json:"trace_id,omitempty"`
+}
+
+// Posts failover events to the webhook in the notify section.
+// Delivery happens on a separate goroutine, so a slow or unreachable
+// webhook never blocks the caller.
+type webhookNotifier struct {
+	url string
+}
+
+func (w webhookNotifier) OnFailover(ctx context.Context, failoverid string, oldmaster string, newmaster string) {
+	body, err := json.Marshal(webhookEvent{
+		Event:     "failover",
+		Id:        failoverid,
+		Old:       oldmaster,
+		New:       newmaster,
+		Timestamp: time.Now().Format(time.RFC3339),
+		TraceId:   traceId(ctx),
+	})
+	if err != nil {
+		logError("failover %s: could not encode webhook payload: %s", failoverid, err)
+		return
+	}
+
+	go postWebhook(fmt.Sprintf("failover %s: webhook", failoverid), w.url, body)
+}
+
+func (w webhookNotifier) OnNoMaster(servers []Server)                       {}
+func (w webhookNotifier) OnSplitBrain(masters []string, servers []Server)   {}
+func (w webhookNotifier) OnCanaryFailed(masters []string, servers []Server) {}
+func (w webhookNotifier) OnRecovered(master string, servers []Server)       {}
+func (w webhookNotifier) OnBouncerUnreachable(attempts int)                 {}
+
+// Posts messages to a Slack incoming webhook
+type slackNotifier struct {
+	url string
+}
+
+func (sl slackNotifier) post(text string) {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		logError("could not encode slack payload: %s", err)
+		return
+	}
+
+	go postWebhook("slack", sl.url, body)
+}
+
+func (sl slackNotifier) OnFailover(ctx context.Context, failoverid string, oldmaster string, newmaster string) {
+	if oldmaster != "" {
+		sl.post(fmt.Sprintf("Rebouncer: master changed %s → %s at %s", oldmaster, newmaster, time.Now().Format(time.RFC3339)))
+	} else {
+		sl.post(fmt.Sprintf("Rebouncer: master set to %s at %s", newmaster, time.Now().Format(time.RFC3339)))
+	}
+}
+
+func (sl slackNotifier) OnNoMaster(servers []Server) {
+	sl.post(":rotating_light: Rebouncer: no master available!")
+}
+
+func (sl slackNotifier) OnSplitBrain(masters []string, servers []Server) {
+	sl.post(fmt.Sprintf(":rotating_light: Rebouncer: more than one master (%s)!", strings.Join(masters, ", ")))
+}
+
+func (sl slackNotifier) OnCanaryFailed(masters []string, servers []Server) {
+	sl.post(fmt.Sprintf(":rotating_light: Rebouncer: canary query failing on master (%s)!", strings.Join(masters, ", ")))
+}
+
+func (sl slackNotifier) OnRecovered(master string, servers []Server) {
+	sl.post(fmt.Sprintf("Rebouncer: master %s available again", master))
+}
+
+func (sl slackNotifier) OnBouncerUnreachable(attempts int) {
+	sl.post(fmt.Sprintf(":rotating_light: Rebouncer: can't reach pgbouncer at startup, %d attempts failed!", attempts))
+}
+
+// Event sent to the PagerDuty Events API v2
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	CustomDetails map[string]string `json:"custom_details"`
+}
+
+// Triggers a PagerDuty incident when there is no usable master or more
+// than one, and resolves it when there is a single master again. All events
+// use the same dedup key, so repeated triggers update the same
+// incident and a resolve closes it.
+type pagerDutyNotifier struct {
+	routingkey string
+}
+
+func (p pagerDutyNotifier) send(action string, summary string, servers []Server) {
+	cfg := getConfig()
+	event := pagerDutyEvent{
+		RoutingKey:  p.routingkey,
+		EventAction: action,
+		DedupKey:    cfg.getString("pagerduty", "dedup_key", "rebouncer"),
+	}
+	if action == "trigger" {
+		source, _ := os.Hostname()
+		details := make(map[string]string)
+		for _, s := range servers {
+			details[s.name] = s.status.String()
+		}
+		event.Payload = &pagerDutyPayload{
+			Summary:       summary,
+			Source:        source,
+			Severity:      "critical",
+			CustomDetails: details,
+		}
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		logError("could not encode pagerduty event: %s", err)
+		return
+	}
+
+	go postWebhook("pagerduty", cfg.getString("pagerduty", "url", "https://events.pagerduty.com/v2/enqueue"), body)
+}
+
+func (p pagerDutyNotifier) OnFailover(ctx context.Context, failoverid string, oldmaster string, newmaster string) {
+}
+
+func (p pagerDutyNotifier) OnNoMaster(servers []Server) {
+	p.send("trigger", "rebouncer: no master available", servers)
+}
+
+func (p pagerDutyNotifier) OnSplitBrain(masters []string, servers []Server) {
+	p.send("trigger", fmt.Sprintf("rebouncer: more than one master (%s)", strings.Join(masters, ", ")), servers)
+}
+
+func (p pagerDutyNotifier) OnCanaryFailed(masters []string, servers []Server) {
+	p.send("trigger", fmt.Sprintf("rebouncer: canary query failing on master (%s)", strings.Join(masters, ", ")), servers)
+}
+
+func (p pagerDutyNotifier) OnRecovered(master string, servers []Server) {
+	p.send("resolve", "", servers)
+}
+
+func (p pagerDutyNotifier) OnBouncerUnreachable(attempts int) {}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A request received by a test webhook
+type webhookRequest struct {
+	contentType string
+	body        []byte
+}
+
+// Start a webhook that responds with the given statuses in turn, and
+// passes on every request it gets
+func startWebhook(t *testing.T, statuses ...int) (*httptest.Server, chan webhookRequest) {
+	requests := make(chan webhookRequest, 10)
+	var mu sync.Mutex
+	n := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		status := statuses[len(statuses)-1]
+		if n < len(statuses) {
+			status = statuses[n]
+		}
+		n++
+		mu.Unlock()
+		requests <- webhookRequest{r.Header.Get("Content-Type"), body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	setConfig(Config{"global": section{"timeout": "1s"}})
+	server, requests := startWebhook(t, http.StatusOK)
+
+	webhookNotifier{server.URL}.OnFailover(context.Background(), "abcd1234", "db1", "db2")
+	var req webhookRequest
+	select {
+	case req = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+	if req.contentType != "application/json" {
+		t.Errorf("content type %s, expected application/json", req.contentType)
+	}
+
+	var payload map[string]string
+	err := json.Unmarshal(req.body, &payload)
+	if err != nil {
+		t.Fatalf("invalid payload %s: %s", req.body, err)
+	}
+	if _, err := time.Parse(time.RFC3339, payload["timestamp"]); err != nil {
+		t.Errorf("invalid timestamp: %s", err)
+	}
+	delete(payload, "timestamp")
+	expected := map[string]string{"event": "failover", "id": "abcd1234", "old": "db1", "new": "db2"}
+	if len(payload) != len(expected) {
+		t.Errorf("payload %v, expected %v", payload, expected)
+	}
+	for k, v := range expected {
+		if payload[k] != v {
+			t.Errorf("%s is %q, expected %q", k, payload[k], v)
+		}
+	}
+}
+
+func TestPostWebhook(t *testing.T) {
+	setConfig(Config{"global": section{"timeout": "1s"}})
+	tests := []struct {
+		name     string
+		statuses []int
+		attempts int
+	}{
+		{"success", []int{http.StatusOK}, 1},
+		{"no content", []int{http.StatusNoContent}, 1},
+		{"retried", []int{http.StatusServiceUnavailable, http.StatusOK}, 2},
+		{"failing", []int{http.StatusInternalServerError}, 2},
+		{"not found", []int{http.StatusNotFound}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, requests := startWebhook(t, test.statuses...)
+			postWebhook("test", server.URL, []byte(`{}`))
+			if len(requests) != test.attempts {
+				t.Errorf("webhook called %d times, expected %d", len(requests), test.attempts)
+			}
+		})
+	}
+
+	// An unreachable webhook gives up after the timeout
+	server, _ := startWebhook(t, http.StatusOK)
+	server.Close()
+	start := time.Now()
+	postWebhook("test", server.URL, []byte(`{}`))
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("unreachable webhook blocked for %s", elapsed)
+	}
+}
+
+// A notifier recording the events it gets
+type recordingNotifier struct {
+	events []string
+}
+
+func (r *recordingNotifier) OnFailover(ctx context.Context, failoverid string, oldmaster string, newmaster string) {
+	r.events = append(r.events, "failover")
+}
+
+func (r *recordingNotifier) OnNoMaster(servers []Server) {
+	r.events = append(r.events, "nomaster")
+}
+
+func (r *recordingNotifier) OnSplitBrain(masters []string, servers []Server) {
+	r.events = append(r.events, "splitbrain")
+}
+
+func (r *recordingNotifier) OnCanaryFailed(masters []string, servers []Server) {
+	r.events = append(r.events, "canaryfailed")
+}
+
+func (r *recordingNotifier) OnRecovered(master string, servers []Server) {
+	r.events = append(r.events, "recovered")
+}
+
+func (r *recordingNotifier) OnBouncerUnreachable(attempts int) {
+	r.events = append(r.events, "bouncer")
+}
+
+func TestDebouncedNotifier(t *testing.T) {
+	setConfig(Config{"notify": section{"alert_debounce": "1h"}})
+	alertSent = make(map[string]time.Time)
+	defer func() { alertSent = make(map[string]time.Time) }()
+
+	r := &recordingNotifier{}
+	n := debounce("test", r)
+	// A flapping cluster only alerts once about each kind of problem,
+	// but every recovery and failover gets through.
+	for i := 0; i < 3; i++ {
+		n.OnNoMaster(nil)
+		n.OnRecovered("db1", nil)
+		n.OnSplitBrain([]string{"db1", "db2"}, nil)
+		n.OnRecovered("db1", nil)
+		n.OnFailover(context.Background(), "abcd1234", "db1", "db2")
+	}
+	expected := []string{
+		"nomaster", "recovered", "splitbrain", "recovered", "failover",
+		"recovered", "recovered", "failover",
+		"recovered", "recovered", "failover",
+	}
+	if !reflect.DeepEqual(r.events, expected) {
+		t.Errorf("got events %v, expected %v", r.events, expected)
+	}
+
+	// Each debounced notifier keeps track of its own alerts
+	other := &recordingNotifier{}
+	debounce("other", other).OnNoMaster(nil)
+	if len(other.events) != 1 {
+		t.Errorf("got events %v from other notifier, expected one", other.events)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Part of the response from the Patroni REST API that we care about
+type patroniStatus struct {
+	ServerVersion int `json:"server_version"`
+}
+
+// Ask the Patroni REST API of a node about one role, returning true
+// if the node has it along with the server version it reports.
+func patroniHasRole(ctx context.Context, baseurl string, role string) (bool, int, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(baseurl, "/")+"/"+role, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, 0, err
+	}
+	defer resp.Body.Close()
+
+	// The body is the same whatever the answer, and the version in it
+	// is only informational, so a body we can't parse is not an error.
+	var status patroniStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	return resp.StatusCode == http.StatusOK, status.ServerVersion, nil
+}
+
+// Check a server using Patroni. By default Patroni alone decides which
+// server is the master, as the leader it has elected. With
+// patronimode set to crosscheck, the regular check is run as well, and
+// a server only counts as master if Patroni agrees, so we never race
+// Patroni during a switchover.
+func checkPatroni(ctx context.Context, server Server, url string) checkResult {
+	leader, version, err := patroniHasRole(ctx, url, "master")
+	if err != nil {
+		logWarn("%s: patroni error: %s", server.name, maskPassword(err.Error()))
+		return checkResult{status: DOWN}
+	}
+
+	if getConfig().getString("global", "patronimode", "replace") == "crosscheck" {
+		result := checkDatabases(ctx, server)
+		if result.status == MASTER && !leader {
+			logWarn("%s: reports master, but is not the patroni leader", server.name)
+			result.status = DOWN
+		}
+		return result
+	}
+
+	if leader {
+		return checkResult{status: MASTER, version: version}
+	}
+	replica, version, err := patroniHasRole(ctx, url, "replica")
+	if err != nil {
+		logWarn("%s: patroni error: %s", server.name, maskPassword(err.Error()))
+		return checkResult{status: DOWN}
+	}
+	if replica {
+		return checkResult{status: STANDBY, version: version}
+	}
+	return checkResult{status: DOWN}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Pool statistics collected from one pgbouncer. The rows are the ones
+// returned by SHOW POOLS and SHOW STATS, with the column names as keys,
+// so they follow whatever the running version of pgbouncer returns.
+type BouncerPools struct {
+	Bouncer string                   `json:"bouncer"`
+	Pools   []map[string]interface{} `json:"pools"`
+	Stats   []map[string]interface{} `json:"stats"`
+
+	// Time the statistics were last collected successfully, and the
+	// error from the last attempt if it failed. On failure, the
+	// statistics from the last successful attempt are kept.
+	Collected time.Time `json:"collected"`
+	Error     string    `json:"error,omitempty"`
+}
+
+var poolStats []BouncerPools
+var poolStatsLock sync.Mutex
+
+// Set while a collection is running, so they never pile up if
+// pgbouncer is slow to respond
+var poolStatsRunning bool
+
+// Run a SHOW command against the pgbouncer admin console, returning
+// each row as a map from column name to value.
+func showRows(conn *sql.DB, command string) ([]map[string]interface{}, error) {
+	rows, err := conn.Query(command)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		err = rows.Scan(pointers...)
+		if err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, col := range columns {
+			// Columns of types the driver doesn't know are
+			// returned as raw bytes.
+			if b, ok := values[i].([]byte); ok {
+				row[col] = string(b)
+			} else {
+				row[col] = values[i]
+			}
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// Collect SHOW POOLS and SHOW STATS from all pgbouncers, if enabled.
+// Runs in the background, since it's not important enough to hold up
+// the main loop.
+func collectPoolStats() {
+	if !getConfig().getBool("global", "poolstats", false) {
+		return
+	}
+
+	poolStatsLock.Lock()
+	if poolStatsRunning {
+		poolStatsLock.Unlock()
+		return
+	}
+	poolStatsRunning = true
+	previous := make(map[string]BouncerPools)
+	for _, p := range poolStats {
+		previous[p.Bouncer] = p
+	}
+	poolStatsLock.Unlock()
+
+	go func() {
+		result := []BouncerPools{}
+		for _, b := range getBouncers() {
+			p := previous[b.String()]
+			p.Bouncer = b.String()
+			p.Error = ""
+
+			var pools, stats []map[string]interface{}
+			var err error
+			conn := getValidBouncerConnection(b)
+			if conn == nil {
+				p.Error = "could not connect"
+			} else {
+				pools, err = showRows(conn, "SHOW POOLS")
+				if err == nil {
+					stats, err = showRows(conn, "SHOW STATS")
+				}
+				conn.Close()
+				if err != nil {
+					logWarn("could not get pool statistics from %s: %s", b, err)
+					p.Error = err.Error()
+				}
+			}
+			if p.Error == "" {
+				p.Pools = pools
+				p.Stats = stats
+				p.Collected = time.Now()
+			}
+			result = append(result, p)
+		}
+
+		poolStatsLock.Lock()
+		defer poolStatsLock.Unlock()
+		poolStats = result
+		poolStatsRunning = false
+	}()
+}
+
+// Return the last collected pool statistics
+func getPoolStats() []BouncerPools {
+	poolStatsLock.Lock()
+	defer poolStatsLock.Unlock()
+	return poolStats
+}
+
+// Pool statistics of all pgbouncers in JSON format
+func httpPoolsHandler(w http.ResponseWriter, r *http.Request) {
+	if !getConfig().getBool("global", "poolstats", false) {
+		http.Error(w, "Pool statistics are not enabled", http.StatusNotFound)
+		return
+	}
+
+	pools := getPoolStats()
+	if pools == nil {
+		pools = []BouncerPools{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(pools)
+	if err != nil {
+		logError("failed to write json pools: %s", err)
+	}
+}
+
+var poolStatsCollectedDesc = prometheus.NewDesc(
+	"rebouncer_pgbouncer_stats_collected_timestamp_seconds",
+	"Time pool statistics were last collected successfully from each pgbouncer.",
+	[]string{"bouncer"}, nil)
+
+// Collector exposing every numeric column of SHOW POOLS and SHOW STATS
+// as a gauge, named after the column. As the columns depend on the
+// version of pgbouncer, they are not described up front.
+type poolCollector struct{}
+
+func (c poolCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c poolCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, p := range getPoolStats() {
+		if p.Collected.IsZero() {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(poolStatsCollectedDesc, prometheus.GaugeValue, float64(p.Collected.UnixNano())/1e9, p.Bouncer)
+		collectRows(ch, "rebouncer_pgbouncer_pool_", []string{"bouncer", "database", "user"}, p.Bouncer, p.Pools)
+		collectRows(ch, "rebouncer_pgbouncer_stats_", []string{"bouncer", "database"}, p.Bouncer, p.Stats)
+	}
+}
+
+// Send the numeric columns of a set of rows as gauges. The labels
+// after the first one are taken from the columns of the same name.
+func collectRows(ch chan<- prometheus.Metric, prefix string, labels []string, bouncer string, rows []map[string]interface{}) {
+	for _, row := range rows {
+		labelvalues := []string{bouncer}
+		for _, l := range labels[1:] {
+			v, _ := row[l].(string)
+			labelvalues = append(labelvalues, v)
+		}
+		for col, val := range row {
+			var f float64
+			switch v := val.(type) {
+			case int64:
+				f = float64(v)
+			case float64:
+				f = v
+			default:
+				continue
+			}
+			desc := prometheus.NewDesc(prefix+col, "Column "+col+" from pgbouncer.", labels, nil)
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, f, labelvalues...)
+		}
+	}
+}
+
+func init() {
+	metricsRegistry.MustRegister(poolCollector{})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A key/value store the name of the current master is published to,
+// for other services to find it. The value is tied to a session or
+// lease with a TTL, so it expires if rebouncer stops keeping it alive.
+type masterStore interface {
+	// Keep the session alive, creating a new one if there is none
+	// or the old one has expired. Returns true if a new session was
+	// created, since the value then has to be written again.
+	keepalive() (bool, error)
+
+	// Write the master to the key, tied to the session
+	put(master string) error
+
+	// Forget about the session after an error, so a new one is
+	// created next time
+	reset()
+
+	// Time to live of the session
+	ttl() time.Duration
+}
+
+// Publishes the master to a store on a goroutine of its own, so a slow
+// or unreachable store never holds up the main loop. Only the most
+// recent master is kept while waiting for the store.
+type masterPublisher struct {
+	name   string
+	store  masterStore
+	master chan string
+	start  sync.Once
+}
+
+func newMasterPublisher(name string, store masterStore) *masterPublisher {
+	return &masterPublisher{name: name, store: store, master: make(chan string, 1)}
+}
+
+// Publish a new master, starting the publisher the first time
+func (p *masterPublisher) publish(master string) {
+	p.start.Do(func() {
+		go p.run()
+	})
+	for {
+		select {
+		case p.master <- master:
+			return
+		default:
+			// Replace the one that hasn't been picked up yet
+			select {
+			case <-p.master:
+			default:
+			}
+		}
+	}
+}
+
+// Keep the session alive at half its TTL, and write the master
+// whenever it changes or the session had to be recreated. Errors are
+// logged and retried on the next round.
+func (p *masterPublisher) run() {
+	master := <-p.master
+	written := false
+	for {
+		created, err := p.store.keepalive()
+		if err != nil {
+			logWarn("%s: could not keep session alive: %s", p.name, err)
+			p.store.reset()
+			written = false
+		} else {
+			if created {
+				written = false
+			}
+			if !written {
+				err = p.store.put(master)
+				if err != nil {
+					logWarn("%s: could not publish master %s: %s", p.name, master, err)
+				} else {
+					logInfo("%s: published master %s", p.name, master)
+					written = true
+				}
+			}
+		}
+
+		select {
+		case master = <-p.master:
+			written = false
+		case <-time.After(p.store.ttl() / 2):
+		}
+	}
+}
+
+// Notifier publishing every new master
+type publishNotifier struct {
+	publisher *masterPublisher
+}
+
+func (n publishNotifier) OnFailover(ctx context.Context, failoverid string, oldmaster string, newmaster string) {
+	if *dryRun {
+		logInfo("failover %s: dry run, would publish master %s to %s", failoverid, newmaster, n.publisher.name)
+		return
+	}
+	n.publisher.publish(newmaster)
+}
+
+func (n publishNotifier) OnNoMaster(servers []Server)                       {}
+func (n publishNotifier) OnSplitBrain(masters []string, servers []Server)   {}
+func (n publishNotifier) OnCanaryFailed(masters []string, servers []Server) {}
+func (n publishNotifier) OnRecovered(master string, servers []Server)       {}
+func (n publishNotifier) OnBouncerUnreachable(attempts int)                 {}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Return the path of the pgbouncer configuration file to use for
+// sending reads to a server
+func readConfigPath(name string) string {
+	cfg := getConfig()
+	return fmt.Sprintf("%s/%s.ini", strings.TrimRight(cfg.getString("global", "readconfigdir", cfg["global"]["configdir"]), "/"), name)
+}
+
+// Return the name of the server the read symlink currently points to,
+// or an empty string if it doesn't point to any of them.
+func currentReadServer(servers []Server) string {
+	target, err := os.Readlink(getConfig()["global"]["readsymlink"])
+	if err != nil {
+		return ""
+	}
+	for _, s := range servers {
+		if target == readConfigPath(s.name) {
+			return s.name
+		}
+	}
+	return ""
+}
+
+// Time the read symlink was last replaced
+var lastReadFlip time.Time
+
+// Pick the server to send reads to. With the lag readpolicy, the current
+// one is kept for as long as it remains a usable standby, so pgbouncer
+// isn't reloaded on every poll, and otherwise the one with the lowest
+// lag is picked. With roundrobin, the next one after the current one is
+// picked once reloadinterval has passed since the last change, so the
+// reads move between all standbys. If there is no usable standby, reads
+// go to the master. Returns nil if there is no master either.
+func chooseReadServer(servers []Server, current string, master *Server) *Server {
+	cfg := getConfig()
+	maxlag := cfg.getDuration("global", "maxlag", 0)
+	policy := cfg.getString("global", "readpolicy", "lag")
+	rotate := policy == "roundrobin" && time.Since(lastReadFlip) >= cfg.getDuration("global", "reloadinterval", 500*time.Millisecond)
+	standbys := []*Server{}
+	for i := range servers {
+		s := &servers[i]
+		if s.status == STANDBY && (maxlag <= 0 || s.lag <= maxlag) {
+			if s.name == current && !rotate {
+				return s
+			}
+			standbys = append(standbys, s)
+		}
+	}
+	if len(standbys) == 0 {
+		if master == nil || master.status != MASTER {
+			return nil
+		}
+		return master
+	}
+
+	switch policy {
+	case "roundrobin":
+		// The servers are sorted by name, so just find the first
+		// one after the current one, wrapping around at the end.
+		for _, s := range standbys {
+			if s.name > current {
+				return s
+			}
+		}
+		return standbys[0]
+	default:
+		best := standbys[0]
+		for _, s := range standbys[1:] {
+			if s.lag < best.lag {
+				best = s
+			}
+		}
+		return best
+	}
+}
+
+// Server the read symlink would have been pointed to in a dry run, so
+// it's only logged once
+var dryRunReadServer string
+
+// Point the read symlink at a server and reload pgbouncer, returning
+// true if it succeeded.
+func flipReadServer(name string) bool {
+	cfg := getConfig()
+	symlink := cfg["global"]["readsymlink"]
+	bouncer := Bouncer{name: "read", connstr: cfg.getString("global", "readpgbouncer", cfg["global"]["pgbouncer"]), symlink: symlink}
+
+	if *dryRun {
+		if dryRunReadServer == name {
+			return true
+		}
+		dryRunReadServer = name
+		lastReadFlip = time.Now()
+		logInfo("dry run, would point read symlink %s to %s and reload %s", symlink, readConfigPath(name), bouncer)
+		return true
+	}
+
+	err := checkBouncerConfig(readConfigPath(name))
+	if err != nil {
+		logError("read configuration for server %s not available: %s", name, err)
+		return false
+	}
+
+	conn := getValidBouncerConnection(bouncer)
+	if conn == nil {
+		// Error already logged
+		return false
+	}
+	defer conn.Close()
+
+	err = swapSymlink(readConfigPath(name), symlink)
+	if err != nil {
+		logError("failed to set read symlink %s for server %s: %s", symlink, name, err)
+		return false
+	}
+
+	// Space out reloads the same way as for failovers, which may
+	// have reloaded pgbouncer in the same poll.
+	wait := cfg.getDuration("global", "reloadinterval", 500*time.Millisecond) - time.Since(lastReload)
+	if wait > 0 {
+		logInfo("waiting %s before reloading pgbouncer for reads", wait)
+		time.Sleep(wait)
+	}
+	lastReload = time.Now()
+	_, err = conn.Exec("RELOAD")
+	if err != nil {
+		logError("failed to reload %s: %s", bouncer, maskPassword(err.Error()))
+		return false
+	}
+	lastReadFlip = time.Now()
+	logInfo("pgbouncer reconfigured to send reads to %s", name)
+	return true
+}
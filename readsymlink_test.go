@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChooseReadServer(t *testing.T) {
+	servers := []Server{
+		{name: "db1", status: MASTER},
+		{name: "db2", status: STANDBY, lag: 3 * time.Second},
+		{name: "db3", status: STANDBY, lag: time.Second},
+		{name: "db4", status: STANDBY, lag: time.Minute},
+		{name: "db5", status: DOWN},
+	}
+	down := []Server{
+		{name: "db1", status: MASTER},
+		{name: "db2", status: DOWN},
+	}
+	nomaster := []Server{
+		{name: "db1", status: DOWN},
+		{name: "db2", status: DOWN},
+	}
+
+	tests := []struct {
+		name     string
+		settings section
+		servers  []Server
+		current  string
+		lastflip time.Duration
+		expected string
+	}{
+		{"lowest lag", section{}, servers, "", time.Hour, "db3"},
+		{"current kept", section{}, servers, "db2", 0, "db2"},
+		{"current kept while lagging more", section{}, servers, "db4", time.Hour, "db4"},
+		{"current lagging past maxlag", section{"maxlag": "10s"}, servers, "db4", time.Hour, "db3"},
+		{"current down", section{}, servers, "db5", time.Hour, "db3"},
+		{"fallback to master", section{}, down, "db2", time.Hour, "db1"},
+		{"no master", section{}, nomaster, "db2", time.Hour, ""},
+		{"roundrobin first", section{"readpolicy": "roundrobin"}, servers, "", time.Hour, "db2"},
+		{"roundrobin next", section{"readpolicy": "roundrobin"}, servers, "db2", time.Hour, "db3"},
+		{"roundrobin wraps around", section{"readpolicy": "roundrobin"}, servers, "db4", time.Hour, "db2"},
+		{"roundrobin skips lagging", section{"readpolicy": "roundrobin", "maxlag": "10s"}, servers, "db3", time.Hour, "db2"},
+		{"roundrobin within reloadinterval", section{"readpolicy": "roundrobin", "reloadinterval": "1m"}, servers, "db2", time.Second, "db2"},
+		{"roundrobin after reloadinterval", section{"readpolicy": "roundrobin", "reloadinterval": "1m"}, servers, "db2", 2 * time.Minute, "db3"},
+		{"roundrobin fallback to master", section{"readpolicy": "roundrobin"}, down, "db2", time.Hour, "db1"},
+	}
+	oldflip := lastReadFlip
+	defer func() { lastReadFlip = oldflip }()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setConfig(Config{"global": test.settings})
+			lastReadFlip = time.Now().Add(-test.lastflip)
+			chosen := chooseReadServer(test.servers, test.current, &test.servers[0])
+			name := ""
+			if chosen != nil {
+				name = chosen.name
+			}
+			if name != test.expected {
+				t.Errorf("chose %q, expected %q", name, test.expected)
+			}
+		})
+	}
+}
@@ -1,12 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
-	_ "github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"log"
+	mathrand "math/rand"
+	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -14,6 +26,8 @@ import (
 
 type Status int
 
+// The string representations of the status are used in the JSON status
+// output and the node commands, so they must not change.
 func (status Status) String() string {
 	if status == DOWN {
 		return "down"
@@ -21,6 +35,8 @@ func (status Status) String() string {
 		return "standby"
 	} else if status == MASTER {
 		return "master"
+	} else if status == MAINTENANCE {
+		return "maintenance"
 	}
 	return "UNKNOWN"
 }
@@ -29,214 +45,1752 @@ const (
 	DOWN Status = iota
 	STANDBY
 	MASTER
+	MAINTENANCE
 )
 
+// Format a server_version_num the way PostgreSQL would
+func formatVersion(version int) string {
+	if version >= 100000 {
+		return fmt.Sprintf("%d.%d", version/10000, version%10000)
+	}
+	return fmt.Sprintf("%d.%d.%d", version/10000, version/100%100, version%100)
+}
+
+// Return the major version part of a server_version_num, which is
+// the first two components before PostgreSQL 10 and the first one
+// after.
+func majorVersion(version int) int {
+	if version >= 100000 {
+		return version / 10000
+	}
+	return version / 100
+}
+
 type Server struct {
 	name      string
 	connstr   string
+	opener    Opener
 	status    Status
 	lastcheck time.Time
 	laststate time.Time
+
+	// Databases to check on this server, and the status of each of
+	// them in the last check. If empty, only the database in the
+	// connection string is checked.
+	databases []string
+	dbstatus  map[string]Status
+
+	// Replication lag as of the last check where this server was a
+	// standby. It is kept after the server becomes master, so we know
+	// how far behind it was when it got promoted.
+	lag time.Duration
+
+	// Last known server_version_num, 0 if never seen
+	version int
+
+	// Set if this server is master and the canary query fails on it
+	canaryfailed bool
+
+	// Set if the last check of this server timed out
+	timedout bool
+
+	// Difference between the clock on the server and the local clock
+	// as of the last check, positive if the server is ahead.
+	skew       time.Duration
+	hasskew    bool
+	skewwarned bool
+
+	// Time this server is next due to be checked
+	nextcheck time.Time
+
+	// State last reported to the node up/down commands
+	hookinit bool
+	hookdown bool
+	hooktime time.Time
+}
+
+// Make a deep copy of a list of servers, so it can be handed to other
+// goroutines while the checks keep updating the original.
+func copyServers(servers []Server) []Server {
+	c := make([]Server, len(servers))
+	copy(c, servers)
+	for i := range c {
+		if c[i].dbstatus != nil {
+			c[i].dbstatus = make(map[string]Status, len(servers[i].dbstatus))
+			for k, v := range servers[i].dbstatus {
+				c[i].dbstatus[k] = v
+			}
+		}
+	}
+	return c
+}
+
+// Quote a value for use in a connection string
+func quoteConnValue(val string) string {
+	return "'" + strings.Replace(strings.Replace(val, `\`, `\\`, -1), `'`, `\'`, -1) + "'"
+}
+
+// Password values in key/value connection strings, and in URLs
+var passwordRegexp = regexp.MustCompile(`(?i)(password\s*=\s*)('(?:[^'\\]|\\.)*'|(?:[^\s'"\\]|\\.)+)`)
+var urlPasswordRegexp = regexp.MustCompile(`(://[^:/@\s]*:)[^@\s]*@`)
+
+// Remove any passwords from a string that may contain connection strings
+// or URLs, so it can safely be logged.
+func maskPassword(s string) string {
+	s = passwordRegexp.ReplaceAllString(s, "${1}xxxxx")
+	return urlPasswordRegexp.ReplaceAllString(s, "${1}xxxxx@")
+}
+
+// Result of checking one server
+type checkResult struct {
+	status  Status
+	version int
+
+	// Replication lag, only measured on standbys
+	lag    time.Duration
+	haslag bool
+
+	// Clock skew, only measured when checking the database directly
+	skew    time.Duration
+	hasskew bool
+
+	// Status of each individual database, if configured
+	dbstatus map[string]Status
 }
 
-var config Config
+// Default query to decide if a server is the master
+const defaultMasterQuery = "SELECT NOT pg_is_in_recovery()"
 
-// Check one server. Does not have timeout functionality, so the
-// calling function must take care of timeouts.
-func checkServer(server Server, retchan chan Status) {
-	db, err := sql.Open("postgres", fmt.Sprintf("%s connect_timeout=%d", server.connstr, config.getInt("global", "timeout", 3)-1))
+// Run the query that decides if a server is the master. It must return
+// a single boolean column, anything else is an error.
+func runMasterQuery(ctx context.Context, db Conn) (bool, error) {
+	rows, err := db.Query(ctx, getConfig().getString("global", "masterquery", defaultMasterQuery))
 	if err != nil {
-		retchan <- DOWN
-		return
+		return false, err
 	}
-	defer db.Close()
-	db.SetMaxIdleConns(0)
+	defer rows.Close()
 
-	err = db.Ping()
+	types, err := rows.ColumnTypeNames()
 	if err != nil {
-		retchan <- DOWN
-		return
+		return false, err
+	}
+	if len(types) != 1 || types[0] != "BOOL" {
+		return false, errors.New("masterquery must return exactly one boolean column")
+	}
+	if !rows.Next() {
+		if rows.Err() != nil {
+			return false, rows.Err()
+		}
+		return false, errors.New("masterquery returned no rows")
 	}
 
-	var inrecovery bool
-	err = db.QueryRow("SELECT pg_is_in_recovery()").Scan(&inrecovery)
+	var ismaster bool
+	err = rows.Scan(&ismaster)
+	return ismaster, err
+}
+
+// Check one database on a server, using the given connection string.
+func checkDatabase(ctx context.Context, server Server, connstr string) checkResult {
+	db, err := server.opener.Open(ctx, connstr, connectTimeout(server.name))
 	if err != nil {
-		log.Printf("%s: query error: %s", server.name, err)
-		retchan <- DOWN
-		return
+		return checkResult{status: DOWN}
 	}
+	defer db.Close()
 
-	if inrecovery {
-		retchan <- STANDBY
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	// The server version can only change across a restart, so only
+	// read it the first time and when a server comes back up.
+	version := server.version
+	if version == 0 || server.status == DOWN {
+		err = db.QueryRow(ctx, "SHOW server_version_num").Scan(&version)
+		if err != nil {
+			logWarn("%s: query error: %s", server.name, maskPassword(err.Error()))
+			return checkResult{status: DOWN}
+		}
+	}
+
+	ismaster, err := runMasterQuery(ctx, db)
+	if err != nil {
+		logWarn("%s: query error: %s", server.name, maskPassword(err.Error()))
+		return checkResult{status: DOWN}
+	}
+
+	// Compare the clock on the server to ours, assuming the query is
+	// answered halfway through the round trip. This is only used for
+	// diagnostics, so a failure doesn't affect the status.
+	var skew time.Duration
+	var epoch float64
+	before := time.Now()
+	err = db.QueryRow(ctx, "SELECT EXTRACT(EPOCH FROM clock_timestamp())").Scan(&epoch)
+	hasskew := err == nil
+	if hasskew {
+		local := before.Add(time.Since(before) / 2)
+		skew = time.Duration(epoch*float64(time.Second)) - time.Duration(local.UnixNano())
 	} else {
-		retchan <- MASTER
+		logWarn("%s: could not get server time: %s", server.name, maskPassword(err.Error()))
+	}
+
+	if ismaster {
+		// Not being in recovery doesn't necessarily mean the server
+		// accepts writes, so optionally make sure it does.
+		if getConfig().getBool("global", "verifywrite", false) {
+			var readonly string
+			err = db.QueryRow(ctx, "SHOW transaction_read_only").Scan(&readonly)
+			if err != nil {
+				logWarn("%s: could not verify that master is writable: %s", server.name, maskPassword(err.Error()))
+				return checkResult{status: DOWN}
+			}
+			if readonly != "off" {
+				logWarn("%s: reports master, but is read-only", server.name)
+				return checkResult{status: DOWN}
+			}
+		}
+		return checkResult{status: MASTER, version: version, skew: skew, hasskew: hasskew}
+	}
+
+	// On a standby, also find out how far behind it is. If everything
+	// received has been replayed there is no lag, otherwise it's the
+	// age of the last replayed transaction.
+	query := "SELECT CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0 ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END"
+	if version < 100000 {
+		query = "SELECT CASE WHEN pg_last_xlog_receive_location() = pg_last_xlog_replay_location() THEN 0 ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END"
+	}
+	var lag float64
+	err = db.QueryRow(ctx, query).Scan(&lag)
+	if err != nil {
+		// Not being able to get the lag doesn't make the server
+		// any less of a standby.
+		logWarn("%s: could not get replication lag: %s", server.name, maskPassword(err.Error()))
+		return checkResult{status: STANDBY, version: version, skew: skew, hasskew: hasskew}
 	}
+	return checkResult{status: STANDBY, version: version, lag: time.Duration(lag * float64(time.Second)), haslag: true, skew: skew, hasskew: hasskew}
+}
+
+// Initial delay between retries of a failed check
+const checkRetryDelay = 100 * time.Millisecond
+
+// Check one server, retrying a failed check up to the configured
+// number of times as long as there is time left before the context
+// deadline. Any query in progress is cancelled when the context is.
+func checkServer(ctx context.Context, server Server) checkResult {
+	retries := int(getConfig().getInt("global", "retries", 0))
+	deadline, _ := ctx.Deadline()
+	delay := checkRetryDelay
+	for attempt := 0; ; attempt++ {
+		result := checkServerOnce(ctx, server)
+		if result.status != DOWN || attempt >= retries || time.Now().Add(delay).After(deadline) {
+			return result
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return result
+		}
+		delay *= 2
+	}
+}
+
+// Check one server once, using Patroni if it's configured for the
+// server.
+func checkServerOnce(ctx context.Context, server Server) checkResult {
+	if url := getConfig().getString("patroni", server.name, ""); url != "" {
+		return checkPatroni(ctx, server, url)
+	}
+	return checkDatabases(ctx, server)
+}
+
+// Check the databases on one server.
+func checkDatabases(ctx context.Context, server Server) checkResult {
+	if len(server.databases) == 0 {
+		return checkDatabase(ctx, server, server.connstr)
+	}
+
+	// Check each of the configured databases in parallel, and consider
+	// the server up only if enough of them respond.
+	type dbResult struct {
+		dbname string
+		result checkResult
+	}
+	dbchan := make(chan dbResult, len(server.databases))
+	for _, dbname := range server.databases {
+		go func(dbname string) {
+			dbchan <- dbResult{dbname, checkDatabase(ctx, server, fmt.Sprintf("%s dbname=%s", server.connstr, quoteConnValue(dbname)))}
+		}(dbname)
+	}
+
+	result := checkResult{status: DOWN, dbstatus: make(map[string]Status)}
+	upcount := 0
+	for _ = range server.databases {
+		r := <-dbchan
+		result.dbstatus[r.dbname] = r.result.status
+		if r.result.status != DOWN {
+			upcount++
+			result.status = r.result.status
+			result.version = r.result.version
+			if r.result.haslag {
+				result.lag = r.result.lag
+				result.haslag = true
+			}
+			if r.result.hasskew {
+				result.skew = r.result.skew
+				result.hasskew = true
+			}
+		}
+	}
+
+	quorum := int(getConfig().getInt("global", "databasequorum", 0))
+	if quorum <= 0 || quorum > len(server.databases) {
+		quorum = len(server.databases)
+	}
+	if upcount < quorum {
+		if upcount > 0 {
+			logWarn("%s: only %d of %d databases responding", server.name, upcount, len(server.databases))
+		}
+		result.status = DOWN
+	}
+	return result
+}
+
+// Return the timeout to use for a server, which is the global timeout
+// unless it has been overridden in the timeouts section.
+func serverTimeout(name string) time.Duration {
+	cfg := getConfig()
+	return cfg.getDuration("timeouts", name, cfg.getDuration("global", "timeout", 3*time.Second))
+}
+
+// Return the timeout for connecting to a server. Unless connecttimeout
+// is set, a second of the server timeout is left for running the
+// queries once connected, or half of it if it's shorter than that.
+func connectTimeout(name string) time.Duration {
+	if timeout := getConfig().getDuration("global", "connecttimeout", 0); timeout > 0 {
+		return timeout
+	}
+	timeout := serverTimeout(name)
+	if timeout < 2*time.Second {
+		return timeout / 2
+	}
+	return timeout - time.Second
+}
+
+// Limit the time spent running queries once connected to a server, if
+// querytimeout is set. Otherwise they are only limited by the context,
+// which is normally the server timeout.
+func withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout := getConfig().getDuration("global", "querytimeout", 0); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Return how often to check a server, which is the global interval
+// unless it has been overridden in the intervals section.
+func serverInterval(name string) time.Duration {
+	cfg := getConfig()
+	return cfg.getDuration("intervals", name, cfg.getDuration("global", "interval", 30*time.Second))
+}
+
+// Return how often the main loop polls, which is the shortest of the
+// global interval and the intervals of individual servers.
+func pollInterval() time.Duration {
+	cfg := getConfig()
+	interval := cfg.getDuration("global", "interval", 30*time.Second)
+	for name := range cfg["intervals"] {
+		if i := cfg.getDuration("intervals", name, interval); i > 0 && i < interval {
+			interval = i
+		}
+	}
+	return interval
 }
 
 // Check one server, timing out after 3 seconds or whatever is in the config.
-func checkServerWithTimeout(server *Server, donechannel chan int) {
-	timeout := time.After(time.Duration(config.getInt("global", "timeout", 3)) * time.Second)
-	retchan := make(chan Status, 1)
+// On timeout the check is cancelled, so it doesn't hold on to a
+// connection after we've given up on it.
+func checkServerWithTimeout(pollctx context.Context, server *Server, donechannel chan int) {
+	_, span := tracer.Start(pollctx, "check", trace.WithAttributes(attribute.String("server", server.name)))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(context.Background(), serverTimeout(server.name))
+	defer cancel()
+	retchan := make(chan checkResult, 1)
+	start := time.Now()
 
 	// Send the actual check
-	go checkServer(*server, retchan)
+	go func(server Server) {
+		retchan <- checkServer(ctx, server)
+	}(*server)
 
 	select {
-	case status := <-retchan:
-		if server.status != status {
-			log.Printf("%s: now %v", server.name, status)
-			server.status = status
+	case result := <-retchan:
+		server.timedout = false
+		checkDuration.WithLabelValues(server.name).Observe(time.Since(start).Seconds())
+		logDebug("%s: check completed in %s, %v", server.name, time.Since(start), result.status)
+		if server.status != result.status {
+			withFields(logFields{"server": server.name, "status": result.status.String()}).Info("%s: now %v", server.name, result.status)
+			server.status = result.status
 			server.laststate = time.Now()
 		}
-	case <-timeout:
+		server.dbstatus = result.dbstatus
+		if result.haslag {
+			server.lag = result.lag
+		}
+		server.skew = result.skew
+		server.hasskew = result.hasskew
+		checkClockSkew(server)
+		if result.version != 0 {
+			if server.version != 0 && server.version != result.version {
+				logInfo("%s: version changed from %s to %s", server.name, formatVersion(server.version), formatVersion(result.version))
+			}
+			server.version = result.version
+		}
+	case <-ctx.Done():
 		// Something timed out, so we're going to ignore the
 		// result and set this node as down.
+		checkTimeoutsTotal.WithLabelValues(server.name).Inc()
+		server.timedout = true
 		if server.status != DOWN {
-			log.Printf("%s: timeout", server.name)
+			withFields(logFields{"server": server.name, "status": DOWN.String()}).Warn("%s: timeout", server.name)
 			server.status = DOWN
 			server.laststate = time.Now()
 		}
+		server.dbstatus = nil
 	}
 	server.lastcheck = time.Now()
+	span.SetAttributes(attribute.String("status", server.status.String()))
+	notifyNodeState(server)
 	donechannel <- 1
 }
 
-// Return a validated connection to pgbouncer. If no connection
-// can be made, logs the error and returns nil.
-func getValidBouncerConnection() *sql.DB {
-	bouncer, err := sql.Open("postgres", config["global"]["pgbouncer"])
-	if err != nil {
-		log.Printf("ERROR: could not connect to pgbouncer: %s", err)
-		return nil
+// Warn when the clock on a server drifts too far from ours, since that
+// makes the timeouts and lag thresholds unreliable. Only warns when the
+// skew crosses the threshold, not on every check.
+func checkClockSkew(server *Server) {
+	maxskew := getConfig().getDuration("global", "maxclockskew", 5*time.Second)
+	if !server.hasskew || maxskew <= 0 {
+		return
+	}
+	skew := server.skew
+	if skew < 0 {
+		skew = -skew
 	}
-	bouncer.SetMaxIdleConns(0)
+	if skew > maxskew && !server.skewwarned {
+		logWarn("%s: clock differs from local clock by %s", server.name, server.skew.Round(time.Millisecond))
+		server.skewwarned = true
+	} else if skew <= maxskew && server.skewwarned {
+		logInfo("%s: clock is back within %s of local clock", server.name, maxskew)
+		server.skewwarned = false
+	}
+}
+
+// Run the canary query against the master, to verify that it's not
+// just up but actually usable by the application. Returns false if
+// the query fails or does not finish within the timeout.
+func checkCanary(server *Server, query string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), serverTimeout(server.name))
+	defer cancel()
+	retchan := make(chan error, 1)
 
-	err = bouncer.Ping()
+	go func(server Server) {
+		db, err := server.opener.Open(ctx, server.connstr, connectTimeout(server.name))
+		if err != nil {
+			retchan <- err
+			return
+		}
+		defer db.Close()
+
+		ctx, cancel := withQueryTimeout(ctx)
+		defer cancel()
+		rows, err := db.Query(ctx, query)
+		if err != nil {
+			retchan <- err
+			return
+		}
+		retchan <- rows.Close()
+	}(*server)
+
+	select {
+	case err := <-retchan:
+		if err != nil {
+			logWarn("%s: canary query failed: %s", server.name, maskPassword(err.Error()))
+			return false
+		}
+		return true
+	case <-ctx.Done():
+		logWarn("%s: canary query timed out", server.name)
+		return false
+	}
+}
+
+// Number of times to retry, and the initial delay between retries,
+// when the configuration directory is unavailable during a failover.
+const configdirRetries = 3
+const configdirRetryDelay = 500 * time.Millisecond
+
+// Return the path of the pgbouncer configuration file for a server
+func serverConfigPath(name string) string {
+	return fmt.Sprintf("%s/%s.ini", strings.TrimRight(getConfig()["global"]["configdir"], "/"), name)
+}
+
+// Make sure the configuration file for a server is available. If the
+// whole configuration directory is missing, it may be a network mount
+// that has temporarily disappeared, so retry a few times with backoff
+// before giving up.
+func waitForServerConfig(failoverid string, name string) bool {
+	configdir := getConfig()["global"]["configdir"]
+	path := serverConfigPath(name)
+	delay := configdirRetryDelay
+	for attempt := 0; ; attempt++ {
+		_, err := os.Stat(path)
+		if err == nil {
+			err = checkBouncerConfig(path)
+			if err != nil {
+				logError("failover %s: configuration for server %s is not valid: %s", failoverid, name, err)
+				return false
+			}
+			return true
+		}
+		_, direrr := os.Stat(configdir)
+		if direrr == nil {
+			// The directory is there but the file isn't, so retrying
+			// is not going to help.
+			logError("failover %s: configuration for server %s not available: %s", failoverid, name, err)
+			return false
+		}
+		if attempt >= configdirRetries {
+			logError("failover %s: configdir %s still unavailable after %d retries: %s", failoverid, configdir, configdirRetries, direrr)
+			return false
+		}
+		logWarn("failover %s: configdir %s unavailable, possibly a transient mount problem. Retrying in %s.", failoverid, configdir, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Atomically replace the symlink at path with one pointing to target.
+// The new symlink is created next to the old one and then renamed over
+// it, so there is never a moment where the symlink does not exist. On
+// failure, the old symlink is left untouched.
+func swapSymlink(target string, path string) error {
+	tmppath := path + ".new"
+
+	// Remove any leftover from an earlier failed attempt
+	os.Remove(tmppath)
+
+	err := os.Symlink(target, tmppath)
 	if err != nil {
-		log.Printf("ERROR: could not connect to pgbouncer: %s", err)
-		return nil
+		return err
 	}
 
-	return bouncer
+	err = os.Rename(tmppath, path)
+	if err != nil {
+		os.Remove(tmppath)
+		return err
+	}
+	return nil
 }
 
-// Actually reconfigure pgbouncer
-func flipActiveMaster(server *Server) {
-	// First connect to pgbouncer to make sure we can
-	bouncer := getValidBouncerConnection()
-	if bouncer == nil {
-		// Error already logged
-		return
+// Atomically replace the file at path with one with the given
+// contents. Like with the symlink, the new file is written next to the
+// old one and renamed over it, so readers never see a partially
+// written file.
+func writeFileAtomic(path string, contents []byte) error {
+	tmppath := path + ".new"
+
+	err := os.WriteFile(tmppath, contents, 0644)
+	if err != nil {
+		os.Remove(tmppath)
+		return err
 	}
-	defer bouncer.Close()
 
-	// Then flip the actual symlink
-	err := os.Remove(config["global"]["symlink"])
+	err = os.Rename(tmppath, path)
 	if err != nil {
-		log.Printf("ERROR: failed to remove old symlink: %s", err)
-		return
+		os.Remove(tmppath)
+		return err
 	}
+	return nil
+}
+
+// Atomically replace the file at path with one containing the name of
+// the master, or an empty file if there is none.
+func writeMasterFile(path string, name string) error {
+	return writeFileAtomic(path, []byte(name+"\n"))
+}
 
-	err = os.Symlink(fmt.Sprintf("%s/%s.ini", strings.TrimRight(config["global"]["configdir"], "/"), server.name), config["global"]["symlink"])
+// Generate a short random identifier for a failover, used to tie
+// together everything logged and notified about it.
+func newFailoverId() string {
+	b := make([]byte, 4)
+	_, err := rand.Read(b)
 	if err != nil {
-		log.Printf("ERROR: failed to set symlink for server %s: %s", server.name, err)
-		return
+		// Should never happen, but fall back to something reasonably
+		// unique rather than failing the failover.
+		return fmt.Sprintf("%08x", time.Now().UnixNano()&0xffffffff)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Run a failover hook, if one is configured, passing it the names of the
+// old and new master. Returns false if the hook failed.
+func runFailoverHook(failoverid string, hook string, oldmaster string, newmaster string) bool {
+	command := getConfig()["global"][hook]
+	if command == "" {
+		return true
 	}
 
-	_, err = bouncer.Exec("RELOAD")
+	timeout := getConfig().getDuration("global", "hooktimeout", getConfig().getDuration("global", "timeout", 3*time.Second))
+	env := []string{
+		"REBOUNCER_OLD_MASTER=" + oldmaster,
+		"REBOUNCER_NEW_MASTER=" + newmaster,
+	}
+	out, err := runCommand(command, env, timeout, oldmaster, newmaster)
+	if out != "" {
+		logInfo("failover %s: %s: %s", failoverid, hook, out)
+	}
 	if err != nil {
-		log.Printf("ERROR: failed to reload pgbouncer: %s", err)
-		return
+		logError("failover %s: %s %s failed: %s", failoverid, hook, command, err)
+		return false
 	}
+	return true
+}
+
+// Point the symlinks of all pgbouncers to the configuration for a
+// server. Several pgbouncers may share the same one. Returns a function
+// that puts them back where they pointed before, and false if they
+// could not all be replaced, in which case that has already been done.
+func swapSymlinks(failoverid string, bouncers []Bouncer, server *Server) (func(), bool) {
+	previous := make(map[string]string)
+	rollback := func() {
+		for symlink, target := range previous {
+			if target == "" {
+				// There was no symlink before, so leave the new
+				// one rather than removing it.
+				continue
+			}
+			err := swapSymlink(target, symlink)
+			if err != nil {
+				logError("failover %s: failed to restore symlink %s to %s: %s", failoverid, symlink, target, err)
+			} else {
+				logInfo("failover %s: restored symlink %s to %s", failoverid, symlink, target)
+			}
+		}
+	}
+	for _, b := range bouncers {
+		if _, ok := previous[b.symlink]; ok {
+			continue
+		}
+		previous[b.symlink], _ = os.Readlink(b.symlink)
 
-	log.Printf("pgbouncer reconfigured for new master %s", server.name)
+		err := swapSymlink(serverConfigPath(server.name), b.symlink)
+		if err != nil {
+			logError("failover %s: failed to set symlink %s for server %s: %s", failoverid, b.symlink, server.name, err)
+			rollback()
+			return nil, false
+		}
+
+		// Make sure the symlink actually points where we expect
+		// before we tell pgbouncer to load it.
+		target, err := os.Readlink(b.symlink)
+		if err != nil {
+			logError("failover %s: failed to read back symlink %s: %s", failoverid, b.symlink, err)
+			rollback()
+			return nil, false
+		}
+		if target != serverConfigPath(server.name) {
+			logError("failover %s: symlink %s points to %s instead of %s, not reloading pgbouncer", failoverid, b.symlink, target, serverConfigPath(server.name))
+			rollback()
+			return nil, false
+		}
+	}
+	return rollback, true
 }
 
-func mainloop(statuschan chan []Server) {
-	servers := []Server{}
-	for name, connstr := range config["servers"] {
-		// Make sure the file exists
-		path := fmt.Sprintf("%s/%s.ini", config["global"]["configdir"], name)
-		_, err := os.Stat(path)
+// Write the configuration generated for a server to the output file.
+// Returns a function that restores the previous contents, and false if
+// it could not be written.
+func writeGeneratedConfig(failoverid string, server *Server, generated []byte) (func(), bool) {
+	output := getConfig()["global"]["output"]
+	previous, readerr := os.ReadFile(output)
+	rollback := func() {
+		if readerr != nil {
+			// There was no file before, so leave the new one rather
+			// than removing it.
+			return
+		}
+		err := writeFileAtomic(output, previous)
 		if err != nil {
-			log.Printf("Could not load %s: %s", path, err)
-			os.Exit(1)
+			logError("failover %s: failed to restore %s: %s", failoverid, output, err)
+		} else {
+			logInfo("failover %s: restored previous contents of %s", failoverid, output)
 		}
-		servers = append(servers, Server{name: name, connstr: connstr})
 	}
-	for {
-		bouncer := getValidBouncerConnection()
-		if bouncer == nil {
-			// Error already logged
-			time.Sleep(5 * time.Second)
+	err := writeFileAtomic(output, generated)
+	if err != nil {
+		logError("failover %s: failed to write %s for server %s: %s", failoverid, output, server.name, err)
+		return nil, false
+	}
+	return rollback, true
+}
+
+// Time pgbouncer was last reloaded. Only used from the main loop.
+var lastReload time.Time
+
+// Actually reconfigure pgbouncer, moving from oldmaster (which is empty
+// if there was no master) to server. Returns true if pgbouncer was
+// successfully pointed at the new master.
+func flipActiveMaster(ctx context.Context, failoverid string, oldmaster string, server *Server) bool {
+	// First connect to all pgbouncers to make sure we can
+	bouncers := getBouncers()
+	conns := getValidBouncerConnections(bouncers)
+	if conns == nil {
+		// Error already logged
+		logWarn("failover %s: aborted, no connection to pgbouncer", failoverid)
+		return false
+	}
+	defer closeBouncerConnections(conns)
+
+	// Make sure the new configuration is actually there before we
+	// remove the old one. In template mode, generate it up front
+	// instead, so nothing is touched if that fails.
+	var generated []byte
+	if templateMode() {
+		var err error
+		generated, err = renderBouncerConfig(server)
+		if err != nil {
+			logError("failover %s: failed to generate configuration for server %s: %s", failoverid, server.name, maskPassword(err.Error()))
+			return false
+		}
+	} else if !waitForServerConfig(failoverid, server.name) {
+		// Error already logged
+		return false
+	}
+
+	// In a dry run, stop here and just say what we would have done
+	if *dryRun {
+		names := []string{}
+		for _, b := range bouncers {
+			names = append(names, b.String())
+		}
+		if generated != nil {
+			logInfo("failover %s: dry run, would write %s for %s", failoverid, getConfig()["global"]["output"], server.name)
 		} else {
-			bouncer.Close()
-			break
+			for _, b := range bouncers {
+				logInfo("failover %s: dry run, would point symlink %s to %s", failoverid, b.symlink, serverConfigPath(server.name))
+			}
 		}
+		logInfo("failover %s: dry run, would reload %s for new master %s", failoverid, strings.Join(names, ", "), server.name)
+		return true
 	}
 
-	log.Printf("Connection to pgbouncer validated, starting polling")
+	// Give the operator a chance to prepare for, or veto, the change
+	if !runFailoverHook(failoverid, "prehook", oldmaster, server.name) {
+		logError("failover %s: aborted by prehook", failoverid)
+		return false
+	}
 
-	// Send initial status
-	statuschan <- servers
+	// Optionally let active queries finish first, and hold new ones
+	// until pgbouncer has been reconfigured.
+	if getConfig().getBool("global", "drain", false) {
+		pauseBouncers(ctx, failoverid, bouncers, conns)
+		defer resumeBouncers(ctx, failoverid, bouncers, conns)
+	}
 
-	// Start a timer that will make our loop tick, and then loop
-	// forever on it.
-	ticker := time.Tick(time.Duration(config.getInt("global", "interval", 30)) * time.Second)
+	// Then put the new configuration in place, remembering what was
+	// there before so it can be put back if the failover doesn't go
+	// through. That way the configuration always matches what
+	// pgbouncer has actually loaded.
+	_, swapspan := tracer.Start(ctx, "symlink swap")
+	var rollback func()
+	var ok bool
+	if generated != nil {
+		rollback, ok = writeGeneratedConfig(failoverid, server, generated)
+	} else {
+		rollback, ok = swapSymlinks(failoverid, bouncers, server)
+	}
+	if !ok {
+		// Error already logged
+		swapspan.SetStatus(codes.Error, "failed to put the new configuration in place")
+		swapspan.End()
+		return false
+	}
+	swapspan.End()
+
+	// Don't reload pgbouncer more often than reloadinterval, in case
+	// we are flapping between masters. The symlink is already in
+	// place, so just hold off on the reload until it's been long
+	// enough.
+	wait := getConfig().getDuration("global", "reloadinterval", 500*time.Millisecond) - time.Since(lastReload)
+	if wait > 0 {
+		logInfo("failover %s: waiting %s before reloading pgbouncer", failoverid, wait)
+		time.Sleep(wait)
+	}
+
+	// Reload all of them. If any of them fails, put the configuration back
+	// and reload the ones that did succeed again, so that they all
+	// stay on the old configuration.
+	_, reloadspan := tracer.Start(ctx, "reload")
+	lastReload = time.Now()
+	reloadedconns := []*sql.DB{}
+	for i, b := range bouncers {
+		_, err := conns[i].Exec("RELOAD")
+		if err != nil {
+			logError("failover %s: failed to reload %s: %s", failoverid, b, maskPassword(err.Error()))
+			reloadspan.RecordError(err)
+		} else {
+			reloadedconns = append(reloadedconns, conns[i])
+		}
+	}
+	if len(reloadedconns) < len(bouncers) {
+		reloadspan.SetStatus(codes.Error, "failed to reload pgbouncer")
+		rollback()
+		for _, conn := range reloadedconns {
+			_, err := conn.Exec("RELOAD")
+			if err != nil {
+				logError("failover %s: failed to reload pgbouncer with the restored configuration: %s", failoverid, maskPassword(err.Error()))
+				reloadspan.RecordError(err)
+			}
+		}
+		reloadspan.End()
+		return false
+	}
+	reloadspan.End()
+
+	withFields(logFields{"event": "failover", "failover_id": failoverid, "server": server.name}).Info("failover %s: pgbouncer reconfigured for new master %s", failoverid, server.name)
+
+	// The failover is done at this point, so a failing posthook is only
+	// logged.
+	runFailoverHook(failoverid, "posthook", oldmaster, server.name)
+	return true
+}
+
+// Query returning whether a server is in recovery, and something that
+// identifies the server itself, so two connections can be compared to
+// see if they ended up on the same one.
+const identityQuery = "SELECT pg_is_in_recovery(), pg_postmaster_start_time()::text"
+
+// Make sure pgbouncer actually sends connections to the new master
+// after being reloaded, by connecting through it using verifyconnstr
+// and comparing the server we end up on with a direct connection to the
+// new master. Does nothing unless verifyconnstr is set.
+func verifyRouting(ctx context.Context, failoverid string, server *Server) bool {
+	connstr, _ := normalizeConnStr(getConfig().getString("global", "verifyconnstr", ""))
+	if connstr == "" || *dryRun {
+		return true
+	}
+	connstr = addTLSDefaults(getConfig(), connstr)
+
+	ctx, span := tracer.Start(ctx, "verify")
+	defer span.End()
+	timeout := serverTimeout(server.name)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var inrecovery bool
+	var want, got string
+	direct, err := server.opener.Open(ctx, server.connstr, connectTimeout(server.name))
+	if err == nil {
+		qctx, qcancel := withQueryTimeout(ctx)
+		err = direct.QueryRow(qctx, identityQuery).Scan(&inrecovery, &want)
+		qcancel()
+		direct.Close()
+	}
+	if err != nil {
+		logError("failover %s: could not connect to new master %s to verify pgbouncer: %s", failoverid, server.name, maskPassword(err.Error()))
+		span.SetStatus(codes.Error, "could not connect to new master")
+		return false
+	}
+
+	through, err := server.opener.Open(ctx, connstr, connectTimeout(server.name))
+	if err == nil {
+		qctx, qcancel := withQueryTimeout(ctx)
+		err = through.QueryRow(qctx, identityQuery).Scan(&inrecovery, &got)
+		qcancel()
+		through.Close()
+	}
+	if err != nil {
+		logError("failover %s: could not connect through pgbouncer to verify new master %s: %s", failoverid, server.name, maskPassword(err.Error()))
+		span.SetStatus(codes.Error, "could not connect through pgbouncer")
+		return false
+	}
+	if inrecovery {
+		logError("failover %s: connections through pgbouncer end up on a standby instead of new master %s", failoverid, server.name)
+		span.SetStatus(codes.Error, "pgbouncer routes to a standby")
+		return false
+	}
+	if got != want {
+		logError("failover %s: connections through pgbouncer end up on a different server than new master %s", failoverid, server.name)
+		span.SetStatus(codes.Error, "pgbouncer routes to a different server")
+		return false
+	}
+	logInfo("failover %s: verified that pgbouncer connects to new master %s", failoverid, server.name)
+	return true
+}
+
+// Check if the symlinks of all pgbouncers currently point to the
+// configuration for the given server, or in template mode, if the
+// output file has the configuration generated for it.
+func bouncerConfiguredFor(server *Server) bool {
+	if templateMode() {
+		generated, err := renderBouncerConfig(server)
+		if err != nil {
+			return false
+		}
+		current, err := os.ReadFile(getConfig()["global"]["output"])
+		return err == nil && bytes.Equal(current, generated)
+	}
+	for _, b := range getBouncers() {
+		target, err := os.Readlink(b.symlink)
+		if err != nil || target != serverConfigPath(server.name) {
+			return false
+		}
+	}
+	return true
+}
+
+// Build the list of servers from the configuration. Servers that are
+// also in the old list keep their state.
+func buildServerList(old []Server) []Server {
+	cfg := getConfig()
+
+	names := []string{}
+	for name := range cfg["servers"] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	servers := []Server{}
+	for _, name := range names {
+		server := Server{name: name, opener: defaultOpener}
+		for _, o := range old {
+			if o.name == name {
+				server = o
+			}
+		}
+		// Invalid URIs are caught when validating the configuration
+		server.connstr, _ = normalizeConnStr(cfg["servers"][name])
+		server.connstr = addTLSDefaults(cfg, server.connstr)
+
+		// The interval may have changed, so check it right away
+		server.nextcheck = time.Time{}
+
+		server.databases = nil
+		for _, dbname := range strings.Split(cfg["databases"][name], ",") {
+			if strings.TrimSpace(dbname) != "" {
+				server.databases = append(server.databases, strings.TrimSpace(dbname))
+			}
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// Return how to handle more than one server reporting master. When
+// priorities are configured they are used by default, so that a brief
+// overlap between an old and a new master is resolved the same way
+// every time.
+func splitBrainMode(c Config) string {
+	if len(c["priorities"]) > 0 {
+		return c.getString("global", "splitbrain", "priority")
+	}
+	return c.getString("global", "splitbrain", "none")
+}
+
+// Return the server with the highest priority from the priorities
+// section, or nil if more than one share the highest priority.
+func highestPriority(servers []*Server) *Server {
+	var best *Server = nil
+	var bestpriority int64
+	tied := false
+	for _, s := range servers {
+		priority := getConfig().getInt("priorities", s.name, 0)
+		if best == nil || priority > bestpriority {
+			best = s
+			bestpriority = priority
+			tied = false
+		} else if priority == bestpriority {
+			tied = true
+		}
+	}
+	if tied {
+		return nil
+	}
+	return best
+}
+
+// Source of randomness for the poll jitter, returning a number in
+// [0,n). Replaceable so the spacing of polls can be predicted.
+var jitterRand = mathrand.Int63n
+
+// Return the time to wait until the next poll: the interval, offset by
+// a random amount within plus or minus the configured jitter, so that
+// many instances don't all hit the servers at the same moment.
+func nextPollDelay() time.Duration {
+	interval := pollInterval()
+	jitter := getConfig().getDuration("global", "jitter", 0)
+	if jitter <= 0 {
+		return interval
+	}
+	delay := interval + time.Duration(jitterRand(int64(2*jitter)+1)) - jitter
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// Return the servers put in maintenance in the configuration
+func configMaintenance(cfg Config) map[string]bool {
+	maintenance := make(map[string]bool)
+	for name := range cfg["maintenance"] {
+		if cfg.getBool("maintenance", name, false) {
+			maintenance[name] = true
+		}
+	}
+	return maintenance
+}
+
+// Find a server by name, returning nil if it does not exist
+func findServer(servers []Server, name string) *Server {
+	for i := 0; i < len(servers); i++ {
+		if servers[i].name == name {
+			return &servers[i]
+		}
+	}
+	return nil
+}
+
+// Source of the time used for the cooldown and nofailback windows.
+// Only replaced in tests, to control how much time passes between polls.
+var failoverClock = time.Now
+
+// Initial delay between attempts at connecting to pgbouncer while
+// starting up
+const bouncerRetryDelay = 1 * time.Second
+
+// Run the main loop, polling all servers and reconfiguring pgbouncer
+// as needed, until the context is cancelled.
+func mainloop(ctx context.Context, statuschan chan Snapshot, historychan chan FailoverEvent, reloadchan chan Config, commandchan chan Command) {
+	servers := buildServerList(nil)
+	delay := bouncerRetryDelay
+	for attempts := 1; ; attempts++ {
+		conns := getValidBouncerConnections(getBouncers())
+		if conns != nil {
+			closeBouncerConnections(conns)
+			break
+		}
+		// Error already logged. Alert once if it keeps failing, but
+		// keep trying.
+		if attempts == int(getConfig().getInt("global", "startup_alert_attempts", 5)) {
+			logError("Could not connect to pgbouncer in %d attempts, still retrying", attempts)
+			getNotifiers().OnBouncerUnreachable(attempts)
+		}
+		// Let the liveness probe know we are still trying, and the
+		// status views why we are not polling yet.
+		statuschan <- Snapshot{lasttick: time.Now(), bouncerattempts: attempts}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		// Never wait longer than an interval, so the liveness probe
+		// keeps seeing us retry.
+		delay *= 2
+		if maxdelay := getConfig().getDuration("global", "interval", 30*time.Second); delay > maxdelay {
+			delay = maxdelay
+		}
+	}
+
+	logInfo("Connection to pgbouncer validated, starting polling")
+
+	// During the settle period we poll but don't act on what we find,
+	// so all nodes get a chance to report in before the first failover.
+	settle := getConfig().getDuration("global", "startup_settle_seconds", 0)
+	settleuntil := time.Now().Add(settle)
+	if settle > 0 {
+		logInfo("Startup settle period active, not reconfiguring pgbouncer for %s", settle)
+	}
 
 	var currentmaster *Server = nil
 
+	// Consecutive failed attempts at failing over to a new master, so
+	// we can give up instead of retrying forever if pgbouncer is
+	// misconfigured.
+	var failedmaster *Server = nil
+	failedattempts := 0
+
+	// Number of consecutive polls a new master must be seen in before
+	// we fail over to it.
+	var candidate *Server = nil
+	candidatecount := 0
+
+	// Time of the last successful failover, and the minimum time that
+	// must pass before the next one, to avoid flapping.
+	var lastflip time.Time
+
+	// New master we refuse to fail over to because it was too far
+	// behind before being promoted
+	var lagblocked *Server = nil
+
+	// New master we refuse to fail over to because too few standbys
+	// are reachable
+	var quorumblocked *Server = nil
+
+	// Time each server was last replaced as master, and the new master
+	// we refuse to fail back to because of it when nofailback is on
+	demoted := make(map[string]time.Time)
+	var failbackblocked *Server = nil
+
+	// Identifier of the most recent failover
+	lastfailoverid := ""
+
+	// State of the cluster as a whole as last notified about: ok if
+	// there is exactly one master, otherwise nomaster or splitbrain.
+	clusterstate := "ok"
+
+	// Server the operator has pinned as master, if any. While pinned,
+	// we don't follow the detected master.
+	pinned := getConfig().getString("global", "pinned", "")
+	if pinned != "" {
+		logInfo("Master pinned to %s by configuration", pinned)
+	}
+
+	// Contents of the masterfile as last written, if it has been
+	var masterfilecontents *string = nil
+
+	// Servers taken out of rotation by the operator. They are not
+	// checked, and never considered for master. The ones put in
+	// maintenance using a command are also tracked on their own, so
+	// they stay in maintenance across a reload.
+	maintenance := configMaintenance(getConfig())
+	runtimemaintenance := make(map[string]bool)
+
+	// When disabled, we keep polling but never reconfigure pgbouncer
+	enabled := getConfig().getBool("global", "enabled", true)
+	if !enabled {
+		logInfo("rebouncer disabled by configuration, not reconfiguring pgbouncer")
+	}
+
+	publish := func() {
+		snapshot := Snapshot{servers: copyServers(servers), lastfailoverid: lastfailoverid, lastfailover: lastflip, pinned: pinned, enabled: enabled, lasttick: time.Now()}
+		if currentmaster != nil {
+			snapshot.currentmaster = currentmaster.name
+		}
+		if lagblocked != nil {
+			snapshot.lagblocked = lagblocked.name
+		}
+		if quorumblocked != nil {
+			snapshot.quorumblocked = quorumblocked.name
+		}
+		if failbackblocked != nil {
+			snapshot.failbackblocked = failbackblocked.name
+		}
+		maxattempts := int(getConfig().getInt("global", "failoverattempts", 10))
+		if failedmaster != nil && maxattempts > 0 && failedattempts >= maxattempts {
+			snapshot.failoverfailing = failedmaster.name
+		}
+		statuschan <- snapshot
+	}
+
+	// Reconfigure pgbouncer for a new master, returning true if it
+	// succeeded. The reason is recorded in the failover history.
+	failover := func(newmaster *Server, reason string) bool {
+		lastfailoverid = newFailoverId()
+		oldmaster := ""
+		if currentmaster != nil {
+			oldmaster = currentmaster.name
+			logInfo("failover %s: Master changed from %s to %s", lastfailoverid, currentmaster.name, newmaster.name)
+		} else {
+			logInfo("failover %s: Master detected as %s", lastfailoverid, newmaster.name)
+		}
+
+		failoverctx, span := tracer.Start(ctx, "failover", trace.WithAttributes(
+			attribute.String("failover.id", lastfailoverid),
+			attribute.String("failover.old", oldmaster),
+			attribute.String("failover.new", newmaster.name),
+			attribute.String("failover.reason", reason)))
+		defer span.End()
+
+		failoversTotal.Inc()
+		if !flipActiveMaster(failoverctx, lastfailoverid, oldmaster, newmaster) {
+			span.SetStatus(codes.Error, "failed to reconfigure pgbouncer")
+			return false
+		}
+		if !verifyRouting(failoverctx, lastfailoverid, newmaster) {
+			// pgbouncer has been reloaded, but doesn't seem to be
+			// using the new master. Treat it as a failed failover,
+			// so it's retried on the next poll.
+			span.SetStatus(codes.Error, "pgbouncer not routing to new master")
+			return false
+		}
+		currentmaster = newmaster
+		lastflip = failoverClock()
+		if oldmaster != "" {
+			demoted[oldmaster] = lastflip
+		}
+		getNotifiers().OnFailover(failoverctx, lastfailoverid, oldmaster, newmaster.name)
+		historychan <- FailoverEvent{
+			Id:        lastfailoverid,
+			Old:       oldmaster,
+			New:       newmaster.name,
+			Timestamp: lastflip.Format(time.RFC3339),
+			Reason:    reason,
+		}
+		return true
+	}
+
+	// Switch over to a new configuration. The pointers into the old
+	// server list are no longer valid, so look up the current master
+	// again by name. Anything in progress towards a new master starts
+	// over.
+	applyConfig := func(newconfig Config) {
+		setConfig(newconfig)
+		currentname := ""
+		if currentmaster != nil {
+			currentname = currentmaster.name
+		}
+		servers = buildServerList(servers)
+		currentmaster = findServer(servers, currentname)
+		if pinned != "" && findServer(servers, pinned) == nil {
+			logInfo("Pinned master %s no longer configured, unpinning", pinned)
+			pinned = ""
+		}
+		lagblocked = nil
+		quorumblocked = nil
+		failbackblocked = nil
+		candidate = nil
+		candidatecount = 0
+		failedmaster = nil
+		failedattempts = 0
+		masterfilecontents = nil
+	}
+
+	// Handle a command from the http interface
+	handleCommand := func(cmd Command) CommandResult {
+		switch cmd.action {
+		case "failover":
+			s := findServer(servers, cmd.server)
+			if s == nil {
+				return CommandResult{http.StatusNotFound, fmt.Sprintf("Unknown server %s", cmd.server)}
+			}
+			if !enabled {
+				return CommandResult{http.StatusConflict, "rebouncer is disabled"}
+			}
+			if pinned != "" && s.name != pinned {
+				return CommandResult{http.StatusConflict, fmt.Sprintf("Master is pinned to %s", pinned)}
+			}
+			if s.status != MASTER && !cmd.force {
+				return CommandResult{http.StatusConflict, fmt.Sprintf("Server %s is %s, not MASTER", s.name, s.status)}
+			}
+			if s == currentmaster {
+				return CommandResult{http.StatusOK, fmt.Sprintf("Server %s is already the active master", s.name)}
+			}
+			logInfo("Manual failover to %s requested", s.name)
+			delete(demoted, s.name)
+			ok := failover(s, "manual")
+			if ok {
+				failedmaster = nil
+				failedattempts = 0
+			}
+			publish()
+			if !ok {
+				return CommandResult{http.StatusInternalServerError, fmt.Sprintf("failover %s: failed to reconfigure pgbouncer for %s", lastfailoverid, s.name)}
+			}
+			return CommandResult{http.StatusOK, fmt.Sprintf("failover %s: master is now %s", lastfailoverid, s.name)}
+		case "pin":
+			s := findServer(servers, cmd.server)
+			if s == nil {
+				return CommandResult{http.StatusNotFound, fmt.Sprintf("Unknown server %s", cmd.server)}
+			}
+			if (s.status == DOWN || s.status == MAINTENANCE) && !cmd.force {
+				return CommandResult{http.StatusConflict, fmt.Sprintf("Server %s is %s", s.name, s.status)}
+			}
+			pinned = s.name
+			logInfo("Master pinned to %s", pinned)
+			// Pinning again is a way to retry after giving up
+			failedmaster = nil
+			failedattempts = 0
+			publish()
+			return CommandResult{http.StatusOK, fmt.Sprintf("Master pinned to %s", pinned)}
+		case "unpin":
+			if pinned == "" {
+				return CommandResult{http.StatusOK, "Master is not pinned"}
+			}
+			logInfo("Master no longer pinned to %s", pinned)
+			pinned = ""
+			publish()
+			return CommandResult{http.StatusOK, "Master unpinned"}
+		case "enable":
+			if !enabled {
+				logInfo("rebouncer enabled")
+				enabled = true
+				publish()
+			}
+			return CommandResult{http.StatusOK, "rebouncer enabled"}
+		case "disable":
+			if enabled {
+				logInfo("rebouncer disabled, not reconfiguring pgbouncer until enabled again")
+				enabled = false
+				publish()
+			}
+			return CommandResult{http.StatusOK, "rebouncer disabled"}
+		case "maintenance":
+			s := findServer(servers, cmd.server)
+			if s == nil {
+				return CommandResult{http.StatusNotFound, fmt.Sprintf("Unknown server %s", cmd.server)}
+			}
+			if s == currentmaster && !cmd.force {
+				return CommandResult{http.StatusConflict, fmt.Sprintf("Server %s is the active master", s.name)}
+			}
+			// The status is changed when the loop polls again,
+			// right after this.
+			maintenance[s.name] = true
+			runtimemaintenance[s.name] = true
+			return CommandResult{http.StatusOK, fmt.Sprintf("Server %s in maintenance", s.name)}
+		case "endmaintenance":
+			s := findServer(servers, cmd.server)
+			if s == nil {
+				return CommandResult{http.StatusNotFound, fmt.Sprintf("Unknown server %s", cmd.server)}
+			}
+			if maintenance[s.name] {
+				logInfo("%s: no longer in maintenance", s.name)
+				delete(maintenance, s.name)
+				s.nextcheck = time.Time{}
+			}
+			delete(runtimemaintenance, s.name)
+			return CommandResult{http.StatusOK, fmt.Sprintf("Server %s not in maintenance", s.name)}
+		case "addserver":
+			// The server is added to the running configuration
+			// only, so it's gone again after a reload unless it
+			// has also been added to the configuration file.
+			if findServer(servers, cmd.server) != nil {
+				return CommandResult{http.StatusConflict, fmt.Sprintf("Server %s already exists", cmd.server)}
+			}
+			if strings.TrimSpace(cmd.connstr) == "" {
+				return CommandResult{http.StatusBadRequest, "No connection string specified"}
+			}
+			if _, err := normalizeConnStr(cmd.connstr); err != nil {
+				return CommandResult{http.StatusBadRequest, err.Error()}
+			}
+			// In template mode, the configuration is generated
+			// when needed instead.
+			if !templateMode() {
+				if err := checkBouncerConfig(serverConfigPath(cmd.server)); err != nil {
+					return CommandResult{http.StatusBadRequest, fmt.Sprintf("No valid configuration for server %s: %s", cmd.server, err)}
+				}
+			}
+			newconfig := getConfig().clone()
+			if newconfig["servers"] == nil {
+				newconfig["servers"] = make(section)
+			}
+			newconfig["servers"][cmd.server] = cmd.connstr
+			applyConfig(newconfig)
+			logInfo("Server %s added, now monitoring %d servers", cmd.server, len(servers))
+			publish()
+			return CommandResult{http.StatusOK, fmt.Sprintf("Server %s added", cmd.server)}
+		case "removeserver":
+			s := findServer(servers, cmd.server)
+			if s == nil {
+				return CommandResult{http.StatusNotFound, fmt.Sprintf("Unknown server %s", cmd.server)}
+			}
+			if s == currentmaster {
+				return CommandResult{http.StatusConflict, fmt.Sprintf("Server %s is the active master", s.name)}
+			}
+			if len(servers) == 1 {
+				return CommandResult{http.StatusConflict, "Cannot remove the last server"}
+			}
+			newconfig := getConfig().clone()
+			delete(newconfig["servers"], s.name)
+			applyConfig(newconfig)
+			logInfo("Server %s removed, now monitoring %d servers", cmd.server, len(servers))
+			publish()
+			return CommandResult{http.StatusOK, fmt.Sprintf("Server %s removed", cmd.server)}
+		}
+		return CommandResult{http.StatusBadRequest, fmt.Sprintf("Unknown command %s", cmd.action)}
+	}
+
+	// Start a timer that will make our loop tick, and then loop
+	// on it until we are cancelled. The timer is re-armed as soon as
+	// it fires, so polls start one interval apart regardless of how
+	// long they take. It is replaced on reload, so make sure whichever
+	// one is current gets stopped.
+	ticker := time.NewTimer(nextPollDelay())
+	defer func() {
+		ticker.Stop()
+	}()
+
 	for {
-		// Make one poll-run across all servers in parallell, each on
-		// their own goroutine. Collect and wait until all are done.
-		donechannel := make(chan int, len(servers))
+		// Make one poll-run across all servers that are due to be
+		// checked, each on their own goroutine. Collect and wait until
+		// all are done. If maxconcurrency is set, no more than that
+		// many checks run at the same time. Servers due within half a
+		// poll interval are checked now, since they would otherwise be
+		// late when the poll interval is jittered.
+		pollctx, pollspan := tracer.Start(ctx, "poll")
+		pollstart := time.Now()
+		due := []*Server{}
 		for i := 0; i < len(servers); i++ {
 			s := &servers[i]
-			go checkServerWithTimeout(s, donechannel)
+			if maintenance[s.name] {
+				if s.status != MAINTENANCE {
+					withFields(logFields{"server": s.name, "status": MAINTENANCE.String()}).Info("%s: now %v", s.name, MAINTENANCE)
+					s.status = MAINTENANCE
+					s.laststate = pollstart
+					s.canaryfailed = false
+				}
+				continue
+			}
+			if pollstart.Add(pollInterval() / 2).After(servers[i].nextcheck) {
+				servers[i].nextcheck = pollstart.Add(serverInterval(servers[i].name))
+				due = append(due, &servers[i])
+			}
+		}
+		donechannel := make(chan int, len(due))
+		maxconcurrency := int(getConfig().getInt("global", "maxconcurrency", 0))
+		var semaphore chan bool = nil
+		if maxconcurrency > 0 {
+			semaphore = make(chan bool, maxconcurrency)
+		}
+		for _, s := range due {
+			go func(s *Server) {
+				if semaphore != nil {
+					semaphore <- true
+					defer func() { <-semaphore }()
+				}
+				checkServerWithTimeout(pollctx, s, donechannel)
+			}(s)
 		}
-		for _ = range servers {
+		for _ = range due {
 			<-donechannel
 		}
 
+		// Run the canary query against the current master, if we have
+		// one. The result is kept for as long as the server remains
+		// master.
+		canaryquery := getConfig().getString("global", "master_canary_query", "")
+		for i := 0; i < len(servers); i++ {
+			s := &servers[i]
+			if s.status != MASTER {
+				s.canaryfailed = false
+			} else if s == currentmaster && canaryquery != "" {
+				failed := !checkCanary(s, canaryquery)
+				if failed != s.canaryfailed {
+					if failed {
+						logWarn("%s: canary query now failing on master", s.name)
+					} else {
+						logInfo("%s: canary query now succeeding on master", s.name)
+					}
+					s.canaryfailed = failed
+				}
+			}
+		}
+
 		// Send off the newly collected status so it can be monitored
 		// immediately.
-		statuschan <- servers
+		publish()
+
+		maxattempts := int(getConfig().getInt("global", "failoverattempts", 10))
+		confirmations := int(getConfig().getInt("global", "confirmations", 1))
+		cooldown := getConfig().getDuration("global", "cooldown", 0)
+		maxlag := getConfig().getDuration("global", "maxlag", 0)
+		minstandbys := int(getConfig().getInt("global", "minstandbys", 0))
+		nofailback := getConfig().getBool("global", "nofailback", false)
+		nofailbackwindow := getConfig().getDuration("global", "nofailbackwindow", time.Hour)
+		standbycount := 0
+		for _, s := range servers {
+			if s.status == STANDBY {
+				standbycount++
+			}
+		}
 
 		// Who's our new master?
 		var newmaster *Server = nil
 		disable := false
+		canaryfailover := getConfig().getBool("global", "master_canary_failover", false)
+		masters := []*Server{}
+		canaryfailing := []string{}
 		for i := 0; i < len(servers); i++ {
 			s := &servers[i]
+			if s.status == MASTER && s.canaryfailed && canaryfailover {
+				logWarn("%s: reports master, but canary query is failing. Ignoring.", s.name)
+				canaryfailing = append(canaryfailing, s.name)
+				continue
+			}
 			if s.status == MASTER {
-				if newmaster != nil {
-					log.Printf("More than one master (at least %s and %s)! This is bad! Not touching anything!", newmaster.name, s.name)
-					disable = true
-				} else {
-					newmaster = s
+				masters = append(masters, s)
+			}
+		}
+		names := []string{}
+		for _, s := range masters {
+			names = append(names, s.name)
+		}
+		if len(masters) == 1 {
+			newmaster = masters[0]
+			if clusterstate != "ok" {
+				getNotifiers().OnRecovered(newmaster.name, copyServers(servers))
+			}
+			clusterstate = "ok"
+		} else if len(canaryfailing) > 0 {
+			// There is a master, it's just not usable, which is
+			// not the same as not having one.
+			if clusterstate != "canaryfailed" {
+				getNotifiers().OnCanaryFailed(canaryfailing, copyServers(servers))
+			}
+			clusterstate = "canaryfailed"
+		} else if len(masters) == 0 {
+			if clusterstate != "nomaster" {
+				getNotifiers().OnNoMaster(copyServers(servers))
+			}
+			clusterstate = "nomaster"
+		} else {
+			if clusterstate != "splitbrain" {
+				getNotifiers().OnSplitBrain(names, copyServers(servers))
+			}
+			clusterstate = "splitbrain"
+			if splitBrainMode(getConfig()) == "priority" {
+				newmaster = highestPriority(masters)
+			}
+			if newmaster != nil {
+				logError("More than one master (%s)! This is bad! Picking %s based on priority!", strings.Join(names, ", "), newmaster.name)
+			} else {
+				logError("More than one master (%s)! This is bad! Not touching anything!", strings.Join(names, ", "))
+				disable = true
+			}
+		}
+
+		// Count for how many consecutive checks we have seen the same
+		// master, so a brief blip doesn't cause a failover. Passes
+		// where it wasn't checked, such as when it has a longer
+		// interval or after a command, don't count as confirmations.
+		if disable {
+			candidate = nil
+			candidatecount = 0
+		} else if newmaster != candidate {
+			candidate = newmaster
+			candidatecount = 1
+		} else {
+			for _, s := range due {
+				if s == candidate {
+					candidatecount++
+					break
 				}
 			}
 		}
 
+		// Any earlier failures were for a different master, so start
+		// counting from scratch. While pinned, the pinned server is
+		// the one we are failing over to.
+		target := newmaster
+		if pinned != "" {
+			target = findServer(servers, pinned)
+		}
+		if target != nil && target != failedmaster {
+			failedmaster = nil
+			failedattempts = 0
+		}
+
 		// Did the master change?
-		if newmaster == nil {
-			log.Printf("No master currently available! Not touching anything!")
+		lagblocked = nil
+		quorumblocked = nil
+		failbackblocked = nil
+		if time.Now().Before(settleuntil) {
+			// Still settling, so don't touch anything.
+		} else if pinned != "" {
+			// Keep pgbouncer pointed at the pinned server, whatever
+			// we detect, and put it back if something else changed it.
+			p := findServer(servers, pinned)
+			if newmaster != nil && newmaster != p {
+				logWarn("Master detected as %s, but pinned to %s. Not following it.", newmaster.name, pinned)
+			}
+			if (p != currentmaster || !bouncerConfiguredFor(p)) && !enabled {
+				logInfo("pgbouncer not configured for pinned master %s, but rebouncer is disabled. Not reconfiguring pgbouncer.", pinned)
+			} else if (p != currentmaster || !bouncerConfiguredFor(p)) && (maxattempts == 0 || failedattempts < maxattempts) {
+				if p == currentmaster {
+					logInfo("pgbouncer no longer configured for pinned master %s, reconfiguring", pinned)
+				}
+				if failover(p, "pinned") {
+					failedmaster = nil
+					failedattempts = 0
+				} else {
+					failedmaster = p
+					failedattempts++
+					if maxattempts > 0 && failedattempts >= maxattempts {
+						logError("failover %s: failed to reconfigure pgbouncer for pinned master %s %d times in a row. Not retrying until it is pinned again.", lastfailoverid, pinned, failedattempts)
+					} else {
+						logWarn("failover %s: failed to reconfigure pgbouncer for pinned master %s, will retry on next poll", lastfailoverid, pinned)
+					}
+				}
+				publish()
+			}
+		} else if newmaster == nil && clusterstate == "canaryfailed" {
+			logError("Canary query failing on master (%s)! Not touching anything!", strings.Join(canaryfailing, ", "))
+		} else if newmaster == nil {
+			logError("No master currently available! Not touching anything!")
 		} else if !disable {
 			// We have a master, and we've not been told to disable.
-			if newmaster != currentmaster {
-				if currentmaster != nil {
-					log.Printf("Master changed from %s to %s", currentmaster.name, newmaster.name)
+			if newmaster != currentmaster && candidatecount < confirmations {
+				logInfo("New master %s seen %d of %d times, waiting for confirmation", newmaster.name, candidatecount, confirmations)
+			} else if newmaster != currentmaster && failoverClock().Sub(lastflip) < cooldown {
+				logInfo("Master changed to %s within %s of the last failover, suppressing failover until cooldown expires", newmaster.name, cooldown)
+			} else if newmaster != currentmaster && maxlag > 0 && newmaster.lag > maxlag {
+				logWarn("New master %s had a replication lag of %s as a standby, more than maxlag %s. Not failing over to it!", newmaster.name, newmaster.lag, maxlag)
+				lagblocked = newmaster
+			} else if newmaster != currentmaster && standbycount < minstandbys {
+				logWarn("New master %s, but only %d standbys reachable, fewer than minstandbys %d. Not failing over to it!", newmaster.name, standbycount, minstandbys)
+				quorumblocked = newmaster
+			} else if newmaster != currentmaster && nofailback && !demoted[newmaster.name].IsZero() && failoverClock().Sub(demoted[newmaster.name]) < nofailbackwindow {
+				logError("Master changed back to %s, which was replaced as master %s ago. Not failing back to it! Use a manual failover to override.", newmaster.name, failoverClock().Sub(demoted[newmaster.name]).Round(time.Second))
+				failbackblocked = newmaster
+			} else if newmaster != currentmaster && !enabled {
+				logInfo("Master changed to %s, but rebouncer is disabled. Not reconfiguring pgbouncer.", newmaster.name)
+			} else if newmaster != currentmaster && (maxattempts == 0 || failedattempts < maxattempts) {
+				if failover(newmaster, "automatic") {
+					failedmaster = nil
+					failedattempts = 0
+				} else {
+					failedmaster = newmaster
+					failedattempts++
+					if maxattempts > 0 && failedattempts >= maxattempts {
+						logError("failover %s: failed to reconfigure pgbouncer for %s %d times in a row, it is possibly misconfigured. Not retrying until the master changes.", lastfailoverid, newmaster.name, failedattempts)
+					} else {
+						logWarn("failover %s: failed to reconfigure pgbouncer for %s, will retry on next poll", lastfailoverid, newmaster.name)
+					}
+				}
+				publish()
+			}
+		}
+
+		// Let others know who the master is, if anyone. A master that
+		// is no longer reachable doesn't count, even if pgbouncer is
+		// still configured for it while a new one is being confirmed
+		// or the cooldown hasn't expired.
+		masterfile := getConfig().getString("global", "masterfile", "")
+		if masterfile != "" {
+			name := ""
+			if newmaster != nil && currentmaster != nil && currentmaster.status == MASTER {
+				name = currentmaster.name
+			}
+			if masterfilecontents == nil || *masterfilecontents != name {
+				var err error
+				if *dryRun {
+					logInfo("dry run, would write master %q to masterfile %s", name, masterfile)
+				} else {
+					err = writeMasterFile(masterfile, name)
+				}
+				if err != nil {
+					logError("failed to write masterfile: %s", err)
 				} else {
-					log.Printf("Master detected as %s", newmaster.name)
+					masterfilecontents = &name
 				}
+			}
+		}
 
-				flipActiveMaster(newmaster)
+		// Keep the read symlink pointed at a usable standby, if
+		// configured. This is independent of failovers, but like them
+		// it's not done while disabled.
+		if getConfig().getString("global", "readsymlink", "") != "" && enabled {
+			current := currentReadServer(servers)
+			target := chooseReadServer(servers, current, currentmaster)
+			if target != nil && target.name != current {
+				flipReadServer(target.name)
+			}
+		}
+
+		sendStatsd(servers, due)
+		collectPoolStats()
+		pollspan.End()
 
-				currentmaster = newmaster
+		// Wait for the next tick, a new configuration or a command.
+		// After either of the latter two we poll again right away.
+		select {
+		case <-ticker.C:
+			ticker.Reset(nextPollDelay())
+		case <-ctx.Done():
+			return
+		case cmd := <-commandchan:
+			cmd.reply <- handleCommand(cmd)
+		case newconfig := <-reloadchan:
+			applyConfig(newconfig)
+			// Servers no longer listed in the configuration come
+			// out of maintenance, unless put there by a command.
+			// They are checked right away, like all servers after
+			// a reload.
+			oldmaintenance := maintenance
+			maintenance = configMaintenance(newconfig)
+			for name := range runtimemaintenance {
+				maintenance[name] = true
+			}
+			for name := range oldmaintenance {
+				if !maintenance[name] && findServer(servers, name) != nil {
+					logInfo("%s: no longer in maintenance", name)
+				}
 			}
+			ticker.Stop()
+			ticker = time.NewTimer(nextPollDelay())
+			logInfo("Configuration reloaded, now monitoring %d servers", len(servers))
+		}
+	}
+}
+
+// Reload the configuration every time we get a SIGHUP, and pass it to
+// the main loop. If the new configuration is not valid, it is ignored
+// and we keep running with the old one. Runs until the context is
+// cancelled, which is also when the main loop stops listening.
+func handleReload(ctx context.Context, reloadchan chan Config) {
+	hupchan := make(chan os.Signal, 1)
+	signal.Notify(hupchan, syscall.SIGHUP)
+	defer signal.Stop(hupchan)
+	for {
+		select {
+		case <-hupchan:
+		case <-ctx.Done():
+			return
+		}
+		logInfo("Received SIGHUP, reloading configuration")
+		cfg, err := readConfig(*configFile)
+		if err == nil {
+			err = validateConfig(cfg)
 		}
+		if err != nil {
+			logError("not reloading invalid configuration:\n%s", err)
+			continue
+		}
+		select {
+		case reloadchan <- cfg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Currently open logfile, if any
+var logFileHandle *os.File
 
-		// Wait for the next tick
-		<-ticker
+// Open the logfile and send all logging to it, closing any previously
+// opened logfile.
+func openLogFile() error {
+	f, err := os.OpenFile(*logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(f)
+	if logFileHandle != nil {
+		logFileHandle.Close()
+	}
+	logFileHandle = f
+	return nil
+}
+
+// Reopen the logfile every time we get a SIGUSR1, so it can be rotated
+// by an external tool such as logrotate.
+func handleLogRotation() {
+	usrchan := make(chan os.Signal, 1)
+	signal.Notify(usrchan, syscall.SIGUSR1)
+	for _ = range usrchan {
+		err := openLogFile()
+		if err != nil {
+			logError("could not reopen log file: %s", err)
+			continue
+		}
+		logInfo("Log file reopened")
 	}
 }
 
@@ -245,43 +1799,174 @@ var configFile = flag.String("config", "rebouncer.ini", "name of configuration f
 var logFile = flag.String("logfile", "", "name of logfile")
 var listenAddr = flag.String("http", "localhost:7100", "http host and port for monitoring interface")
 var pidfile = flag.String("pidfile", "", "file to write pid to")
+var showVersion = flag.Bool("version", false, "print version and exit")
+var dryRun = flag.Bool("dryrun", false, "log what would be done on failover instead of doing it")
+var checkOnly = flag.Bool("check", false, "validate the configuration and exit")
+var checkConnect = flag.Bool("checkconnect", false, "with -check, also try to connect to all servers and pgbouncers")
+
+// Validate the configuration without starting anything, and return the
+// exit code to use. All problems found are printed, not just the first.
+func runConfigCheck() int {
+	cfg, err := readConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	problems := []string{}
+	err = validateConfig(cfg)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if *checkConnect {
+		setConfig(cfg)
+		for _, b := range getBouncers() {
+			db, err := sql.Open(bouncerDriver, b.connstr)
+			if err == nil {
+				err = db.Ping()
+				db.Close()
+			}
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("could not connect to %s: %s", b, maskPassword(err.Error())))
+			}
+		}
+		for _, server := range buildServerList(nil) {
+			ctx, cancel := context.WithTimeout(context.Background(), serverTimeout(server.name))
+			db, err := server.opener.Open(ctx, server.connstr, connectTimeout(server.name))
+			cancel()
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("could not connect to server %s: %s", server.name, maskPassword(err.Error())))
+				continue
+			}
+			db.Close()
+		}
+	}
+
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%s\n", strings.Join(problems, "\n"))
+		return 1
+	}
+	fmt.Printf("Configuration %s OK\n", *configFile)
+	return 0
+}
 
 func main() {
 	flag.Parse()
 
-	config = loadConfig(*configFile)
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+	if *checkOnly {
+		os.Exit(runConfigCheck())
+	}
+
+	cfg := loadConfig(*configFile)
+	err := validateConfig(cfg)
+	if err != nil {
+		logFatal("Invalid configuration:\n%s", err)
+	}
+	setConfig(cfg)
 
 	if *logFile != "" {
-		f, err := os.OpenFile(*logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		err := openLogFile()
+		if err != nil {
+			logFatal("error opening log file: %v", err)
+		}
+		go handleLogRotation()
+	}
+
+	if getConfig().getBool("global", "syslog", false) {
+		err := startSyslog(getConfig().getString("global", "syslogfacility", "daemon"), getConfig().getString("global", "syslogtag", "rebouncer"))
 		if err != nil {
-			log.Fatalf("error opening log file: %v", err)
+			logFatal("error connecting to syslog: %v", err)
 		}
-		defer f.Close()
-		log.SetOutput(f)
 	}
 
 	if *pidfile != "" {
 		pid := syscall.Getpid()
 		f, err := os.OpenFile(*pidfile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 		if err != nil {
-			log.Fatalf("error opening pid file: %v", err)
+			logFatal("error opening pid file: %v", err)
 		}
 		fmt.Fprintf(f, "%d\n", pid)
 		f.Close()
 	}
 
 	// Start our status collector
-	statuschan := make(chan []Server)
-	requestchan = make(chan chan []Server)
-	go statuscollector(statuschan)
+	statuschan := make(chan Snapshot)
+	historychan := make(chan FailoverEvent)
+	requestchan = make(chan chan Snapshot)
+	subscribechan = make(chan chan Snapshot)
+	unsubscribechan = make(chan chan Snapshot)
+	go statuscollector(statuschan, historychan)
 
 	// Something in the log to indicate we're good to go
-	log.Printf("rebouncer starting up...")
+	logInfo("%s starting up...", versionString())
+	if *dryRun {
+		logInfo("Dry run, pgbouncer will not be reconfigured")
+	}
+
+	// Reload the configuration on SIGHUP, for as long as the main
+	// loop is running
+	ctx, cancel := context.WithCancel(context.Background())
+	reloadchan := make(chan Config)
+	go handleReload(ctx, reloadchan)
+
+	// Trace failovers and polls, if configured
+	stopTracing, err := startTracing()
+	if err != nil {
+		logFatal("error setting up tracing: %v", err)
+	}
+
+	// Push metrics, if configured
+	go runPushgateway(ctx)
+
+	// Send metrics to statsd, if configured
+	go runStatsd(ctx)
 
 	// Start our main loop
-	go mainloop(statuschan)
+	commandchan = make(chan Command)
+	mainloopdone := make(chan bool)
+	go func() {
+		mainloop(ctx, statuschan, historychan, reloadchan, commandchan)
+		close(mainloopdone)
+	}()
+
+	// Start our status http server
+	httpServers := startHttpServers()
+
+	// Run until we are told to stop
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigchan
+	logInfo("Received %s, shutting down", sig)
+
+	// Stop the http servers first, letting any requests in progress
+	// finish, since they need the status collector.
+	shutdownctx, shutdowncancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdowncancel()
+	for _, httpServer := range httpServers {
+		err = httpServer.Shutdown(shutdownctx)
+		if err != nil {
+			logError("failed to shut down http server: %s", err)
+		}
+	}
+
+	// Then the main loop, and once it's done nothing more will be sent
+	// to the status collector.
+	cancel()
+	<-mainloopdone
+	close(statuschan)
+	close(historychan)
 
-	// Start our status http server. This will also block
-	// forever.
-	runHttpServer()
+	err = stopTracing(shutdownctx)
+	if err != nil {
+		logError("failed to flush traces: %s", err)
+	}
+
+	if *pidfile != "" {
+		os.Remove(*pidfile)
+	}
+	logInfo("rebouncer stopped")
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Maximum size of a statsd packet, to stay below the MTU
+const statsdMaxPacket = 1400
+
+// Batches of lines to send to statsd. Filled by the main loop and
+// emptied by runStatsd, so that sending never holds up polling.
+var statsdchan = make(chan []string, 10)
+
+// Queue lines in the statsd line protocol to be sent, dropping them if
+// the sender has fallen behind.
+func queueStatsd(lines []string) {
+	select {
+	case statsdchan <- lines:
+	default:
+		logWarn("statsd sender falling behind, dropping metrics")
+	}
+}
+
+// Send the queued lines to the server in the statsd section, until the
+// context is cancelled. The address is only looked up when the first
+// lines are sent, and again if it changes on reload or sending fails.
+// Problems sending are only logged, since statsd is not allowed to get
+// in the way of polling.
+func runStatsd(ctx context.Context) {
+	var conn net.Conn
+	addr := ""
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		var lines []string
+		select {
+		case lines = <-statsdchan:
+		case <-ctx.Done():
+			return
+		}
+
+		cfg := getConfig()
+		host := cfg.getString("statsd", "host", "")
+		if host == "" {
+			continue
+		}
+		newaddr := net.JoinHostPort(host, cfg.getString("statsd", "port", "8125"))
+		if conn != nil && newaddr != addr {
+			conn.Close()
+			conn = nil
+		}
+		if conn == nil {
+			var err error
+			conn, err = net.Dial("udp", newaddr)
+			if err != nil {
+				logWarn("could not send to statsd: %s", err)
+				continue
+			}
+			addr = newaddr
+		}
+		err := writeStatsdLines(conn, lines)
+		if err != nil {
+			logWarn("could not send to statsd: %s", err)
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+// Write lines to statsd, putting as many lines as fit in each packet
+func writeStatsdLines(conn net.Conn, lines []string) error {
+	packet := ""
+	for _, line := range lines {
+		if packet != "" && len(packet)+1+len(line) > statsdMaxPacket {
+			_, err := conn.Write([]byte(packet))
+			if err != nil {
+				return err
+			}
+			packet = ""
+		}
+		if packet != "" {
+			packet += "\n"
+		}
+		packet += line
+	}
+	_, err := conn.Write([]byte(packet))
+	return err
+}
+
+// Queue the result of a poll for statsd, if configured: a gauge with the
+// status of each server, and a counter of timeouts among the checks
+// made in this poll, which with per-server intervals is not all of them.
+func sendStatsd(servers []Server, checked []*Server) {
+	host := getConfig().getString("statsd", "host", "")
+	if host == "" {
+		return
+	}
+	prefix := getConfig().getString("statsd", "prefix", "rebouncer")
+
+	timeouts := 0
+	lines := []string{}
+	for _, s := range servers {
+		// Dots separate the levels of the metric name
+		name := strings.Replace(s.name, ".", "_", -1)
+		lines = append(lines, fmt.Sprintf("%s.server.%s.status:%d|g", prefix, name, s.status))
+	}
+	for _, s := range checked {
+		if s.timedout {
+			timeouts++
+		}
+	}
+	lines = append(lines, fmt.Sprintf("%s.check_timeouts:%d|c", prefix, timeouts))
+	queueStatsd(lines)
+}
+
+// Counts failovers in statsd
+type statsdNotifier struct{}
+
+func (sd statsdNotifier) OnFailover(ctx context.Context, failoverid string, oldmaster string, newmaster string) {
+	prefix := getConfig().getString("statsd", "prefix", "rebouncer")
+	queueStatsd([]string{fmt.Sprintf("%s.failovers:1|c", prefix)})
+}
+
+func (sd statsdNotifier) OnNoMaster(servers []Server)                       {}
+func (sd statsdNotifier) OnSplitBrain(masters []string, servers []Server)   {}
+func (sd statsdNotifier) OnCanaryFailed(masters []string, servers []Server) {}
+func (sd statsdNotifier) OnRecovered(master string, servers []Server)       {}
+func (sd statsdNotifier) OnBouncerUnreachable(attempts int)                 {}
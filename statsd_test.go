@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsd(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	host, port, _ := net.SplitHostPort(listener.LocalAddr().String())
+	setConfig(Config{"statsd": section{"host": host, "port": port, "prefix": "test"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runStatsd(ctx)
+
+	servers := []Server{
+		{name: "db1", status: MASTER},
+		{name: "db2.example", status: STANDBY, timedout: true},
+		{name: "db3", status: DOWN, timedout: true},
+	}
+	// Only the checks made in this poll count towards the timeouts
+	sendStatsd(servers, []*Server{&servers[0], &servers[1]})
+	statsdNotifier{}.OnFailover(context.Background(), "abcd1234", "db1", "db2")
+
+	// All lines of a poll are sent in a single packet, over the same
+	// connection as the failover
+	expected := []string{
+		"test.server.db1.status:2|g\ntest.server.db2_example.status:1|g\ntest.server.db3.status:0|g\ntest.check_timeouts:1|c",
+		"test.failovers:1|c",
+	}
+	var sender net.Addr
+	buf := make([]byte, statsdMaxPacket)
+	for i, e := range expected {
+		listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, addr, err := listener.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("packet %d not received: %s", i, err)
+		}
+		if string(buf[:n]) != e {
+			t.Errorf("packet %d is %q, expected %q", i, buf[:n], e)
+		}
+		if sender != nil && addr.String() != sender.String() {
+			t.Errorf("packet %d sent from %s, expected %s", i, addr, sender)
+		}
+		sender = addr
+	}
+}
+
+func TestWriteStatsdLines(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("udp", listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Lines that don't fit together are split over several packets
+	line := strings.Repeat("x", statsdMaxPacket/2)
+	err = writeStatsdLines(conn, []string{line, line, line})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2*statsdMaxPacket)
+	for i := 0; i < 3; i++ {
+		listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("packet %d not received: %s", i, err)
+		}
+		if string(buf[:n]) != line {
+			t.Errorf("packet %d is %d bytes, expected %d", i, n, len(line))
+		}
+	}
+}
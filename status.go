@@ -1,60 +1,296 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"runtime"
+	"strings"
+	"sync"
 	"time"
 )
 
+// Snapshot of the state of rebouncer, as published by the main loop
+type Snapshot struct {
+	servers        []Server
+	currentmaster  string
+	lastfailoverid string
+
+	// Time of the last successful failover, zero if there hasn't
+	// been one since startup
+	lastfailover time.Time
+
+	// Set to the name of the new master if we have given up on
+	// failing over to it after repeated failures
+	failoverfailing string
+
+	// Set to the name of the new master if we refuse to fail over
+	// to it because of replication lag
+	lagblocked string
+
+	// Set to the name of the new master if we refuse to fail over
+	// to it because too few standbys are reachable
+	quorumblocked string
+
+	// Set to the name of the new master if we refuse to fail back to
+	// it because of nofailback
+	failbackblocked string
+
+	// Set to the name of the server the master is pinned to
+	pinned string
+
+	// False if we have been told not to reconfigure pgbouncer
+	enabled bool
+
+	// Time the main loop last completed a poll, or a retry of the
+	// connection to pgbouncer while starting up
+	lasttick time.Time
+
+	// Number of failed attempts at connecting to pgbouncer while
+	// starting up, 0 once it has been reached
+	bouncerattempts int
+
+	// The most recent failovers, oldest first. Only filled in by the
+	// status collector when the snapshot is requested.
+	history []FailoverEvent
+}
+
+// A successful reconfiguration of pgbouncer for a new master
+type FailoverEvent struct {
+	Id        string `json:"id"`
+	Old       string `json:"old"`
+	New       string `json:"new"`
+	Timestamp string `json:"timestamp"`
+
+	// What caused the failover: automatic, manual or pinned
+	Reason string `json:"reason"`
+}
+
+// Time rebouncer was started
+var startTime = time.Now()
+
 // Global channel to talk to the status collector
-var requestchan chan chan []Server
+var requestchan chan chan Snapshot
+
+// Global channels to start and stop getting a new snapshot from the
+// status collector every time the status changes
+var subscribechan chan chan Snapshot
+var unsubscribechan chan chan Snapshot
+
+// Check if anything has changed between two snapshots that is worth
+// telling subscribers about. The replication lag and the time of the
+// last check change on every poll, so they are not compared.
+func statusChanged(old Snapshot, new Snapshot) bool {
+	if old.currentmaster != new.currentmaster ||
+		old.lastfailoverid != new.lastfailoverid ||
+		old.failoverfailing != new.failoverfailing ||
+		old.lagblocked != new.lagblocked ||
+		old.quorumblocked != new.quorumblocked ||
+		old.failbackblocked != new.failbackblocked ||
+		old.pinned != new.pinned ||
+		old.enabled != new.enabled ||
+		len(old.servers) != len(new.servers) {
+		return true
+	}
+	for i := range old.servers {
+		o, n := old.servers[i], new.servers[i]
+		if o.name != n.name || o.status != n.status || o.version != n.version || o.canaryfailed != n.canaryfailed {
+			return true
+		}
+	}
+	return false
+}
 
 // Constantly running goroutine that handles passing of status
 // messages. Accepts new statuses from the running checks, and
-// dispatches it to any status reporting goroutines.
-func statuscollector(statuschan chan []Server) {
-	status := []Server{}
+// dispatches it to any status reporting goroutines. Also keeps the
+// history of recent failovers, and passes every change on to the
+// subscribers. A subscriber that hasn't picked up the previous change
+// yet misses the new one, so a slow client can never block us.
+func statuscollector(statuschan chan Snapshot, historychan chan FailoverEvent) {
+	status := Snapshot{}
+	history := []FailoverEvent{}
+	subscribers := make(map[chan Snapshot]bool)
 	for {
 		select {
-		case newstatus := <-statuschan:
+		case newstatus, ok := <-statuschan:
+			if !ok {
+				// The main loop has exited
+				for sub := range subscribers {
+					close(sub)
+				}
+				return
+			}
+			changed := statusChanged(status, newstatus)
 			status = newstatus
+			if changed {
+				for sub := range subscribers {
+					select {
+					case sub <- status:
+					default:
+					}
+				}
+			}
+		case sub := <-subscribechan:
+			subscribers[sub] = true
+			sub <- status
+		case sub := <-unsubscribechan:
+			delete(subscribers, sub)
+		case event, ok := <-historychan:
+			if !ok {
+				historychan = nil
+				continue
+			}
+			history = append(history, event)
+			size := int(getConfig().getInt("global", "historysize", 50))
+			if len(history) > size {
+				history = history[len(history)-size:]
+			}
 		case req := <-requestchan:
+			status.history = make([]FailoverEvent, len(history))
+			copy(status.history, history)
 			req <- status
 		}
 	}
 }
 
-// Return an array with all server statuses, by fetcing from
-// the status collector.
-func getServerStatus() []Server {
-	c := make(chan []Server, 1)
-	requestchan <- c
-	return <-c
+// Return the current snapshot of the state, by fetching from the
+// status collector. Gives up when the context is done, so a stuck
+// status collector can't hold up the caller forever.
+func getSnapshot(ctx context.Context) (Snapshot, error) {
+	c := make(chan Snapshot, 1)
+	select {
+	case requestchan <- c:
+	case <-ctx.Done():
+		return Snapshot{}, ctx.Err()
+	}
+	select {
+	case snapshot := <-c:
+		return snapshot, nil
+	case <-ctx.Done():
+		return Snapshot{}, ctx.Err()
+	}
+}
+
+// Return the current snapshot for an http request, giving up after the
+// global timeout so requests can't pile up if the status collector is
+// stuck. If it can't be fetched, responds with a 503 and returns false.
+func requestSnapshot(w http.ResponseWriter, r *http.Request) (Snapshot, bool) {
+	ctx, cancel := context.WithTimeout(r.Context(), getConfig().getDuration("global", "timeout", 3*time.Second))
+	defer cancel()
+	snapshot, err := getSnapshot(ctx)
+	if err != nil {
+		http.Error(w, "Status not available, rebouncer may be stuck", http.StatusServiceUnavailable)
+		return Snapshot{}, false
+	}
+	return snapshot, true
+}
+
+// Start getting snapshots from the status collector every time the
+// status changes, beginning with the current one. The channel is
+// closed when the status collector exits.
+func subscribe(ctx context.Context) (chan Snapshot, error) {
+	c := make(chan Snapshot, 1)
+	select {
+	case subscribechan <- c:
+		return c, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Stop getting snapshots on a channel returned by subscribe
+func unsubscribe(c chan Snapshot) {
+	for {
+		select {
+		case unsubscribechan <- c:
+			return
+		case _, ok := <-c:
+			if !ok {
+				// The status collector has already exited
+				return
+			}
+		}
+	}
 }
 
 //-----------
 // http views
 //-----------
 func httpRootHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, ok := requestSnapshot(w, r)
+	if !ok {
+		return
+	}
+
 	fmt.Fprintf(w, "Current time: %s\n", time.Now().Local())
 	fmt.Fprintf(w, "Active goroutines: %d\n", runtime.NumGoroutine())
+
+	if snapshot.currentmaster != "" {
+		fmt.Fprintf(w, "Current master: %s\n", snapshot.currentmaster)
+	}
+	if len(snapshot.servers) > 0 && !snapshot.enabled {
+		fmt.Fprintf(w, "rebouncer is disabled, not reconfiguring pgbouncer\n")
+	}
+	if snapshot.pinned != "" {
+		fmt.Fprintf(w, "Master pinned to: %s\n", snapshot.pinned)
+	}
+	if snapshot.lastfailoverid != "" {
+		fmt.Fprintf(w, "Last failover: %s\n", snapshot.lastfailoverid)
+	}
 	fmt.Fprintf(w, "\n\nNode status:\n")
 
-	servers := getServerStatus()
+	servers := snapshot.servers
+	if snapshot.bouncerattempts > 0 {
+		fmt.Fprintf(w, "Starting up, can't reach pgbouncer (%d failed attempts).\n", snapshot.bouncerattempts)
+		return
+	}
+	if len(servers) == 0 {
+		fmt.Fprintf(w, "Initializing, no poll completed yet.\n")
+		return
+	}
 
 	for _, s := range servers {
-		fmt.Fprintf(w, "%s: %s (last checked %s)\n", s.name, s.status, s.lastcheck)
+		fmt.Fprintf(w, "%s: %s (last checked %s)", s.name, s.status, s.lastcheck)
+		if s.version != 0 {
+			fmt.Fprintf(w, " (version %s)", formatVersion(s.version))
+		}
+		if s.canaryfailed {
+			fmt.Fprintf(w, " (canary query failing)")
+		}
+		fmt.Fprintf(w, "\n")
+		for _, dbname := range s.databases {
+			fmt.Fprintf(w, "  %s: %s\n", dbname, s.dbstatus[dbname])
+		}
 	}
 }
 
 func httpNodesHandler(w http.ResponseWriter, r *http.Request) {
-	servers := getServerStatus()
+	snapshot, ok := requestSnapshot(w, r)
+	if !ok {
+		return
+	}
+	servers := snapshot.servers
 
 	for _, s := range servers {
-		fmt.Fprintf(w, "%s: %s\n", s.name, s.status)
+		details := []string{}
+		if s.status == STANDBY {
+			details = append(details, fmt.Sprintf("lag %s", s.lag))
+		}
+		// A server that has been down since startup has never
+		// changed state.
+		if !s.laststate.IsZero() {
+			details = append(details, fmt.Sprintf("since %s", time.Since(s.laststate).Round(time.Second)))
+		}
+		if len(details) > 0 {
+			fmt.Fprintf(w, "%s: %s (%s)\n", s.name, s.status, strings.Join(details, ", "))
+		} else {
+			fmt.Fprintf(w, "%s: %s\n", s.name, s.status)
+		}
 	}
 }
 
@@ -62,43 +298,447 @@ func httpNagiosHandler(w http.ResponseWriter, r *http.Request) {
 	mastercount := 0
 	standbycount := 0
 	downcount := 0
+	maintenancecount := 0
+	canaryfailed := ""
+	versions := make(map[int]bool)
 	oldestcheck := time.Now()
+	maxlag := getConfig().getDuration("global", "maxlag", 0)
+	lagging := 0
+	stale := ""
+	var staleage, stalelimit time.Duration
 
-	servers := getServerStatus()
+	snapshot, ok := requestSnapshot(w, r)
+	if !ok {
+		return
+	}
+	servers := snapshot.servers
+
+	if alertafter := int(getConfig().getInt("global", "startup_alert_attempts", 5)); alertafter > 0 && snapshot.bouncerattempts >= alertafter {
+		fmt.Fprintf(w, "CRITICAL: rebouncer starting up, can't reach pgbouncer (%d failed attempts)", snapshot.bouncerattempts)
+		return
+	}
+	if snapshot.bouncerattempts > 0 {
+		fmt.Fprintf(w, "UNKNOWN: rebouncer starting up, can't reach pgbouncer (%d failed attempts)", snapshot.bouncerattempts)
+		return
+	}
+	if len(servers) == 0 {
+		// Nothing has been published yet, so we don't know anything
+		// about the state of the cluster.
+		fmt.Fprintf(w, "UNKNOWN: rebouncer initializing, no poll completed yet")
+		return
+	}
 
 	for _, s := range servers {
+		if s.status == MAINTENANCE {
+			// Taken out of rotation on purpose, so nothing to
+			// alert about
+			maintenancecount++
+			continue
+		}
 		if s.status == MASTER {
 			mastercount++
+			if s.canaryfailed {
+				canaryfailed = s.name
+			}
 		} else if s.status == STANDBY {
 			standbycount++
+			if maxlag > 0 && s.lag > maxlag {
+				lagging++
+			}
 		} else {
 			downcount++
 		}
+		if s.status != DOWN && s.version != 0 {
+			versions[majorVersion(s.version)] = true
+		}
 		if oldestcheck.After(s.lastcheck) {
 			oldestcheck = s.lastcheck
 		}
+		// Each server has its own interval, so it's stale after
+		// three of its own intervals without a check.
+		if limit := serverInterval(s.name) * 3; time.Since(s.lastcheck) > limit && stale == "" {
+			stale = s.name
+			staleage = time.Since(s.lastcheck)
+			stalelimit = limit
+		}
 	}
 
 	secondssincelast := int64(time.Now().Sub(oldestcheck).Seconds())
-	maxage := config.getInt("global", "interval", 30) * 3
 
 	if mastercount == 0 {
 		fmt.Fprintf(w, "CRITICAL: No master available (%d standbys, %d down)", standbycount, downcount)
 	} else if mastercount > 1 {
 		fmt.Fprintf(w, "CRITICAL: Multiple masters available! Split brain waning! (%d masters, %d standbys, %d down)", mastercount, standbycount, downcount)
+	} else if snapshot.failoverfailing != "" {
+		fmt.Fprintf(w, "CRITICAL: Failover to %s persistently failing, pgbouncer possibly misconfigured", snapshot.failoverfailing)
+	} else if snapshot.lagblocked != "" {
+		fmt.Fprintf(w, "CRITICAL: Not failing over to %s, replication lag above maxlag", snapshot.lagblocked)
+	} else if snapshot.quorumblocked != "" {
+		fmt.Fprintf(w, "CRITICAL: Not failing over to %s, fewer than minstandbys standbys reachable", snapshot.quorumblocked)
+	} else if snapshot.failbackblocked != "" {
+		fmt.Fprintf(w, "CRITICAL: Not failing back to previous master %s", snapshot.failbackblocked)
+	} else if canaryfailed != "" {
+		fmt.Fprintf(w, "WARNING: canary query failing on master %s", canaryfailed)
 	} else if downcount > 0 {
 		fmt.Fprintf(w, "WARNING: %d servers down (%d master, %d standbys active)", downcount, mastercount, standbycount)
-	} else if secondssincelast > maxage {
-		fmt.Fprintf(w, "WARNING: oldest check %d seconds ago, more than %d", secondssincelast, maxage)
+	} else if stale != "" {
+		fmt.Fprintf(w, "WARNING: last check of %s %d seconds ago, more than %d", stale, int64(staleage.Seconds()), int64(stalelimit.Seconds()))
+	} else if lagging > 0 {
+		fmt.Fprintf(w, "WARNING: %d standbys lagging more than %s", lagging, maxlag)
+	} else if len(versions) > 1 {
+		fmt.Fprintf(w, "WARNING: version skew, %d different major versions active", len(versions))
 	} else {
 		fmt.Fprintf(w, "OK: %d masters, %d standbys active", mastercount, standbycount)
 	}
+
+	// Performance data, for graphing
+	fmt.Fprintf(w, " | master=%d standby=%d down=%d maintenance=%d oldest_check=%ds", mastercount, standbycount, downcount, maintenancecount, secondssincelast)
+
+	// With format=perf, also include the lag of each standby, with
+	// maxlag as the critical threshold if set. Single quotes in labels
+	// are escaped by doubling them.
+	if r.FormValue("format") == "perf" {
+		threshold := ""
+		if maxlag > 0 {
+			threshold = fmt.Sprintf("%g", maxlag.Seconds())
+		}
+		for _, s := range servers {
+			if s.status == STANDBY {
+				fmt.Fprintf(w, " 'lag_%s'=%gs;;%s", strings.Replace(s.name, "'", "''", -1), s.lag.Seconds(), threshold)
+			}
+		}
+	}
+}
+
+// Format of each server in the JSON status
+type jsonServerStatus struct {
+	Name            string            `json:"name"`
+	Status          string            `json:"status"`
+	StatusCode      int               `json:"status_code"`
+	LastCheck       string            `json:"last_check"`
+	LastStateChange string            `json:"last_state_change"`
+	Version         int               `json:"version,omitempty"`
+	LagSeconds      *float64          `json:"lag_seconds,omitempty"`
+	CanaryFailed    bool              `json:"canary_failed,omitempty"`
+	ClockSkew       *float64          `json:"clock_skew_seconds,omitempty"`
+	Databases       map[string]string `json:"databases,omitempty"`
 }
 
-func runHttpServer() {
+// Format of the JSON status
+type jsonStatus struct {
+	CurrentMaster  string             `json:"current_master"`
+	LastFailoverId string             `json:"last_failover_id,omitempty"`
+	LastFailover   string             `json:"last_failover,omitempty"`
+	Pinned         string             `json:"pinned,omitempty"`
+	Enabled        bool               `json:"enabled"`
+	Servers        []jsonServerStatus `json:"servers"`
+}
+
+// Simple health check for HTTP based probes, such as load balancers.
+// Returns 200 if there is exactly one master and all servers have been
+// checked recently, and 503 otherwise, with the reason in the body.
+func httpHealthHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, ok := requestSnapshot(w, r)
+	if !ok {
+		return
+	}
+	servers := snapshot.servers
+	if snapshot.bouncerattempts > 0 {
+		http.Error(w, "starting up, can't reach pgbouncer", http.StatusServiceUnavailable)
+		return
+	}
+	if len(servers) == 0 {
+		http.Error(w, "initializing, no poll completed yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	mastercount := 0
+	stale := ""
+	for _, s := range servers {
+		if s.status == MASTER {
+			mastercount++
+		}
+		if s.status != MAINTENANCE && time.Since(s.lastcheck) > serverInterval(s.name)*3 && stale == "" {
+			stale = fmt.Sprintf("%s last checked %d seconds ago", s.name, int64(time.Since(s.lastcheck).Seconds()))
+		}
+	}
+
+	if mastercount == 0 {
+		http.Error(w, "no master available", http.StatusServiceUnavailable)
+	} else if mastercount > 1 {
+		http.Error(w, fmt.Sprintf("%d masters available", mastercount), http.StatusServiceUnavailable)
+	} else if stale != "" {
+		http.Error(w, stale, http.StatusServiceUnavailable)
+	} else if snapshot.quorumblocked != "" {
+		http.Error(w, fmt.Sprintf("not failing over to %s, fewer than minstandbys standbys reachable", snapshot.quorumblocked), http.StatusServiceUnavailable)
+	} else {
+		fmt.Fprintf(w, "OK\n")
+	}
+}
+
+// Liveness probe, returning 200 as long as the main loop keeps running,
+// and 503 if it has not completed a poll for three intervals.
+func httpLivezHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, ok := requestSnapshot(w, r)
+	if !ok {
+		return
+	}
+	limit := getConfig().getDuration("global", "interval", 30*time.Second) * 3
+	since := time.Since(snapshot.lasttick)
+	if snapshot.lasttick.IsZero() {
+		since = time.Since(startTime)
+	}
+	if since > limit {
+		http.Error(w, fmt.Sprintf("main loop last ran %d seconds ago", int64(since.Seconds())), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "OK\n")
+}
+
+// Readiness probe, returning 200 when there is exactly one master and
+// pgbouncer is configured for it, and 503 otherwise.
+func httpReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, ok := requestSnapshot(w, r)
+	if !ok {
+		return
+	}
+	if snapshot.bouncerattempts > 0 {
+		http.Error(w, "starting up, can't reach pgbouncer", http.StatusServiceUnavailable)
+		return
+	}
+	if len(snapshot.servers) == 0 {
+		http.Error(w, "initializing, no poll completed yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	masters := []string{}
+	for _, s := range snapshot.servers {
+		if s.status == MASTER {
+			masters = append(masters, s.name)
+		}
+	}
+	if len(masters) == 0 {
+		http.Error(w, "no master available", http.StatusServiceUnavailable)
+	} else if len(masters) > 1 {
+		http.Error(w, fmt.Sprintf("%d masters available", len(masters)), http.StatusServiceUnavailable)
+	} else if snapshot.currentmaster != masters[0] {
+		http.Error(w, fmt.Sprintf("pgbouncer not configured for master %s", masters[0]), http.StatusServiceUnavailable)
+	} else {
+		fmt.Fprintf(w, "OK\n")
+	}
+}
+
+// Format a timestamp for JSON output, leaving it empty if it was never set
+func jsonTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// Build the JSON status from a snapshot
+func buildJsonStatus(snapshot Snapshot) jsonStatus {
+	status := jsonStatus{
+		CurrentMaster:  snapshot.currentmaster,
+		LastFailoverId: snapshot.lastfailoverid,
+		LastFailover:   jsonTime(snapshot.lastfailover),
+		Pinned:         snapshot.pinned,
+		Enabled:        snapshot.enabled,
+		Servers:        []jsonServerStatus{},
+	}
+	for _, s := range snapshot.servers {
+		js := jsonServerStatus{
+			Name:            s.name,
+			Status:          s.status.String(),
+			StatusCode:      int(s.status),
+			LastCheck:       jsonTime(s.lastcheck),
+			LastStateChange: jsonTime(s.laststate),
+			Version:         s.version,
+			CanaryFailed:    s.canaryfailed,
+		}
+		if s.status == STANDBY {
+			lag := s.lag.Seconds()
+			js.LagSeconds = &lag
+		}
+		if s.hasskew {
+			skew := s.skew.Seconds()
+			js.ClockSkew = &skew
+		}
+		if len(s.databases) > 0 {
+			js.Databases = make(map[string]string)
+			for _, dbname := range s.databases {
+				js.Databases[dbname] = s.dbstatus[dbname].String()
+			}
+		}
+		status.Servers = append(status.Servers, js)
+	}
+	return status
+}
+
+func httpStatusJsonHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, ok := requestSnapshot(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(buildJsonStatus(snapshot))
+	if err != nil {
+		logError("failed to write json status: %s", err)
+	}
+}
+
+// Closed when the http server is shutting down, to end any streams
+// that would otherwise keep it from doing so
+var streamsdone = make(chan bool)
+
+// Stream the JSON status as server-sent events, sending the current
+// status right away and then a new one every time it changes. A
+// comment is sent as a keepalive whenever nothing has changed for an
+// interval.
+func httpEventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), getConfig().getDuration("global", "timeout", 3*time.Second))
+	c, err := subscribe(ctx)
+	cancel()
+	if err != nil {
+		http.Error(w, "Status not available, rebouncer may be stuck", http.StatusServiceUnavailable)
+		return
+	}
+	defer unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	keepalive := time.NewTicker(getConfig().getDuration("global", "interval", 30*time.Second))
+	defer keepalive.Stop()
+	for {
+		select {
+		case snapshot, ok := <-c:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(buildJsonStatus(snapshot))
+			if err != nil {
+				logError("failed to encode json status: %s", err)
+				return
+			}
+			fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+		case <-keepalive.C:
+			fmt.Fprintf(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-streamsdone:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// The most recent failovers in JSON format, oldest first
+func httpHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, ok := requestSnapshot(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(snapshot.history)
+	if err != nil {
+		logError("failed to write json history: %s", err)
+	}
+}
+
+// Every http server closes streamsdone when shutting down, so make
+// sure it only happens once
+var closeStreams sync.Once
+
+// Return the address the status http server listens on. The -http
+// flag wins if given, then the listen setting in the http section.
+func httpListenAddr() string {
+	addr := getConfig().getString("http", "listen", *listenAddr)
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "http" {
+			addr = *listenAddr
+		}
+	})
+	return addr
+}
+
+// Start an http server on the given address in the background
+func startListener(addr string, handler http.Handler, tlsconfig *tls.Config, description string) *http.Server {
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: tlsconfig}
+	server.RegisterOnShutdown(func() {
+		closeStreams.Do(func() {
+			close(streamsdone)
+		})
+	})
+
+	if tlsconfig != nil {
+		logInfo("Starting %s http listener at https://%s", description, addr)
+	} else {
+		logInfo("Starting %s http listener at http://%s", description, addr)
+	}
+	go func() {
+		var err error
+		if tlsconfig != nil {
+			// The certificate is already loaded into the TLS
+			// configuration.
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			logFatal("%s http listener on %s failed: %s", description, addr, err)
+		}
+	}()
+	return server
+}
+
+// Start the status http server in the background, and the separate
+// metrics one if configured, returning the servers so they can be shut
+// down.
+func startHttpServers() []*http.Server {
 	http.HandleFunc("/", httpRootHandler)
 	http.HandleFunc("/nodes", httpNodesHandler)
 	http.HandleFunc("/nagios", httpNagiosHandler)
-	log.Printf("Starting status http listener at http://%s", *listenAddr)
-	http.ListenAndServe(*listenAddr, nil)
+	http.HandleFunc("/health", httpHealthHandler)
+	http.HandleFunc("/livez", httpLivezHandler)
+	http.HandleFunc("/readyz", httpReadyzHandler)
+	http.HandleFunc("/version", httpVersionHandler)
+	http.HandleFunc("/status.json", httpStatusJsonHandler)
+	http.HandleFunc("/history", httpHistoryHandler)
+	http.HandleFunc("/pools", httpPoolsHandler)
+	http.HandleFunc("/events", httpEventsHandler)
+	http.HandleFunc("/ws", httpWsHandler)
+	metrics := metricsHandler()
+	http.Handle("/metrics", metrics)
+	http.HandleFunc("/failover", httpFailoverHandler)
+	http.HandleFunc("/pin", httpPinHandler)
+	http.HandleFunc("/enable", httpEnableHandler)
+	http.HandleFunc("/disable", httpDisableHandler)
+	http.HandleFunc("/maintenance", httpMaintenanceHandler)
+	http.HandleFunc("/servers", httpServersHandler)
+	http.HandleFunc("/servers/", httpServersHandler)
+
+	tlsconfig, err := getHttpTlsConfig()
+	if err != nil {
+		logFatal("could not set up TLS for http listener: %s", err)
+	}
+
+	servers := []*http.Server{
+		startListener(httpListenAddr(), requireAuth(http.DefaultServeMux), tlsconfig, "status"),
+	}
+
+	// The metrics listener only serves the metrics, so it can be
+	// exposed more widely than the status one.
+	if addr := getConfig().getString("http", "metricslisten", ""); addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		servers = append(servers, startListener(addr, requireAuth(mux), tlsconfig, "metrics"))
+	}
+	return servers
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Start a status collector for the duration of a test, returning the
+// channel to send it snapshots on
+func startStatusCollector(t *testing.T) chan Snapshot {
+	requestchan = make(chan chan Snapshot)
+	subscribechan = make(chan chan Snapshot)
+	unsubscribechan = make(chan chan Snapshot)
+	statuschan := make(chan Snapshot)
+	collectordone := make(chan bool)
+	go func() {
+		statuscollector(statuschan, make(chan FailoverEvent))
+		close(collectordone)
+	}()
+	t.Cleanup(func() {
+		close(statuschan)
+		<-collectordone
+	})
+	return statuschan
+}
+
+// Hammer the status collector from all sides at once, to be run with
+// the race detector.
+func TestStatusCollector(t *testing.T) {
+	setConfig(Config{"global": section{}})
+	requestchan = make(chan chan Snapshot)
+	subscribechan = make(chan chan Snapshot)
+	unsubscribechan = make(chan chan Snapshot)
+	statuschan := make(chan Snapshot)
+	historychan := make(chan FailoverEvent)
+	collectordone := make(chan bool)
+	go func() {
+		statuscollector(statuschan, historychan)
+		close(collectordone)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				snapshot, err := getSnapshot(ctx)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				// Every request gets its own copy of the history
+				if len(snapshot.history) > 0 {
+					snapshot.history[0].New = "modified"
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				c, err := subscribe(ctx)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				<-c
+				unsubscribe(c)
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		status := MASTER
+		if i%2 == 0 {
+			status = STANDBY
+		}
+		statuschan <- Snapshot{servers: []Server{{name: "db1", status: status}}, currentmaster: "db1"}
+		historychan <- FailoverEvent{Id: "test", New: "db1"}
+	}
+	wg.Wait()
+
+	snapshot, err := getSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.history) != 50 {
+		t.Errorf("history has %d entries, expected 50", len(snapshot.history))
+	}
+	for _, event := range snapshot.history {
+		if event.New != "db1" {
+			t.Errorf("history modified through a snapshot: %v", event)
+			break
+		}
+	}
+
+	// Subscribers still around get their channel closed when the
+	// collector exits.
+	c, err := subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(statuschan)
+	<-collectordone
+	for _ = range c {
+	}
+}
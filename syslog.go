@@ -0,0 +1,49 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"daemon": syslog.LOG_DAEMON,
+	"user":   syslog.LOG_USER,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// Connect to the local syslog daemon and send all logging there,
+// with the syslog priority matching the log level.
+func startSyslog(facility string, tag string) error {
+	priority, ok := syslogFacilities[facility]
+	if !ok {
+		return fmt.Errorf("unknown syslog facility %s", facility)
+	}
+	w, err := syslog.New(priority|syslog.LOG_INFO, tag)
+	if err != nil {
+		return err
+	}
+
+	syslogOutput = func(level string, msg string) {
+		switch level {
+		case "debug":
+			w.Debug(msg)
+		case "warn":
+			w.Warning(msg)
+		case "error", "fatal":
+			w.Err(msg)
+		default:
+			w.Info(msg)
+		}
+	}
+	return nil
+}
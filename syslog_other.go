@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+)
+
+func startSyslog(facility string, tag string) error {
+	return errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"text/template"
+)
+
+// Data available to the pgbouncer configuration template. The
+// connection details are taken from the connection string of the
+// master, and are empty if it doesn't set them.
+type templateData struct {
+	Name     string
+	Connstr  string
+	Host     string
+	Port     string
+	Dbname   string
+	User     string
+	Password string
+}
+
+// Check if pgbouncer configuration is generated from a template,
+// instead of switching a symlink between static files.
+func templateMode() bool {
+	return getConfig().getString("global", "template", "") != ""
+}
+
+// Parse the configured template, failing on references to anything
+// that doesn't exist rather than silently leaving it empty.
+func parseBouncerTemplate(path string) (*template.Template, error) {
+	return template.New(filepath.Base(path)).Option("missingkey=error").ParseFiles(path)
+}
+
+// Render the pgbouncer configuration for a server from the template
+func renderBouncerConfig(server *Server) ([]byte, error) {
+	tmpl, err := parseBouncerTemplate(getConfig()["global"]["template"])
+	if err != nil {
+		return nil, err
+	}
+
+	connstr, err := normalizeConnStr(server.connstr)
+	if err != nil {
+		return nil, err
+	}
+	data := templateData{
+		Name:     server.name,
+		Connstr:  connstr,
+		Host:     connStrValue(connstr, "host"),
+		Port:     connStrValue(connstr, "port"),
+		Dbname:   connStrValue(connstr, "dbname"),
+		User:     connStrValue(connstr, "user"),
+		Password: connStrValue(connstr, "password"),
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
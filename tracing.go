@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer for all spans. Until a tracer provider has been set up, and
+// if tracing is not configured at all, this does nothing.
+var tracer = otel.Tracer("github.com/mhagander/rebouncer")
+
+// Start exporting traces to the OTLP endpoint in the tracing section,
+// if one is configured. Returns a function that flushes any remaining
+// spans and stops the exporter.
+func startTracing() (func(context.Context) error, error) {
+	cfg := getConfig()
+	endpoint := cfg.getString("tracing", "endpoint", "")
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if cfg.getBool("tracing", "insecure", false) {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", cfg.getString("tracing", "service_name", "rebouncer")))),
+	)
+	otel.SetTracerProvider(provider)
+	logInfo("Sending traces to %s", endpoint)
+	return provider.Shutdown, nil
+}
+
+// Return the trace id of the span in the context, or an empty string
+// if there is none.
+func traceId(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
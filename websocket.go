@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"time"
+)
+
+// Message sent to websocket clients, either the status or a heartbeat
+type wsMessage struct {
+	Type   string      `json:"type"`
+	Time   string      `json:"time"`
+	Status *jsonStatus `json:"status,omitempty"`
+}
+
+var wsUpgrader = websocket.Upgrader{}
+
+// Stream the JSON status over a websocket, sending the current status
+// right away and then a new one every time it changes, and a heartbeat
+// every interval. The client can send {"cmd":"refresh"} to get the
+// current status again.
+func httpWsHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already responded to the client
+		return
+	}
+	defer conn.Close()
+
+	// Read requests from the client on a goroutine of its own, as
+	// reading blocks. It exits when the connection is closed.
+	refreshchan := make(chan bool, 1)
+	readdone := make(chan bool)
+	go func() {
+		defer close(readdone)
+		for {
+			var req struct {
+				Cmd string `json:"cmd"`
+			}
+			err := conn.ReadJSON(&req)
+			if err != nil {
+				return
+			}
+			if req.Cmd == "refresh" {
+				select {
+				case refreshchan <- true:
+				default:
+				}
+			}
+		}
+	}()
+
+	// Don't let a client that doesn't read what we send hold us up
+	// for more than a timeout.
+	timeout := getConfig().getDuration("global", "timeout", 3*time.Second)
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	c, err := subscribe(ctx)
+	cancel()
+	if err != nil {
+		return
+	}
+	defer unsubscribe(c)
+
+	heartbeat := time.NewTicker(getConfig().getDuration("global", "interval", 30*time.Second))
+	defer heartbeat.Stop()
+	for {
+		msg := wsMessage{Time: time.Now().Format(time.RFC3339)}
+		select {
+		case snapshot, ok := <-c:
+			if !ok {
+				return
+			}
+			status := buildJsonStatus(snapshot)
+			msg.Type = "status"
+			msg.Status = &status
+		case <-refreshchan:
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			snapshot, err := getSnapshot(ctx)
+			cancel()
+			if err != nil {
+				continue
+			}
+			status := buildJsonStatus(snapshot)
+			msg.Type = "status"
+			msg.Status = &status
+		case <-heartbeat.C:
+			msg.Type = "heartbeat"
+		case <-readdone:
+			return
+		case <-streamsdone:
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		err := conn.WriteJSON(msg)
+		if err != nil {
+			return
+		}
+	}
+}